@@ -1,11 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -27,6 +28,43 @@ type anthropicRequest struct {
 	Messages    []messageParam `json:"messages"`
 }
 
+// anthropicStreamRequest adds the stream flag on the wire without storing
+// it in the conversation context.
+type anthropicStreamRequest struct {
+	anthropicRequest
+	Stream bool `json:"stream"`
+}
+
+type anthropicStreamEvent struct {
+	Type    string             `json:"type"`
+	Message *anthropicResponse `json:"message,omitempty"`
+	Delta   struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// tokenUsage is the usage a response reported, or nil if it had none.
+func (u *anthropicUsage) tokenUsage() *TokenUsage {
+	if u == nil {
+		return nil
+	}
+	return &TokenUsage{InputTokens: u.InputTokens, OutputTokens: u.OutputTokens}
+}
+
 type anthropicResponse struct {
 	ID      string `json:"id"`
 	Type    string `json:"type"`
@@ -35,14 +73,11 @@ type anthropicResponse struct {
 		Type string `json:"type"`
 		Text string `json:"text"`
 	} `json:"content"`
-	Model        string  `json:"model"`
-	StopReason   string  `json:"stop_reason"`
-	StopSequence *string `json:"stop_sequence"`
-	Usage        struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
-	Error *struct {
+	Model        string          `json:"model"`
+	StopReason   string          `json:"stop_reason"`
+	StopSequence *string         `json:"stop_sequence"`
+	Usage        *anthropicUsage `json:"usage"`
+	Error        *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
 }
@@ -65,25 +100,7 @@ func backfillReponse(req *anthropicRequest, resp anthropicResponse) *anthropicRe
 }
 
 func collectLatestResponses(req *anthropicRequest) string {
-	var responses []string
-
-	// Iterate through messages in reverse order
-	for i := len(req.Messages) - 1; i >= 0; i-- {
-		msg := req.Messages[i]
-		if msg.Role != "assistant" {
-			break
-		}
-		responses = append(responses, msg.Content)
-	}
-
-	// Reverse the responses to maintain chronological order
-	for i := 0; i < len(responses)/2; i++ {
-		j := len(responses) - 1 - i
-		responses[i], responses[j] = responses[j], responses[i]
-	}
-
-	// Join all responses with newlines
-	return strings.Join(responses, "\n")
+	return collectLatestMessages(req.Messages)
 }
 
 func buildRequest(p *PromptDeclaration, vars PromptVariables) (*anthropicRequest, []byte, error) {
@@ -94,34 +111,22 @@ func buildRequest(p *PromptDeclaration, vars PromptVariables) (*anthropicRequest
 		Messages:    []messageParam{},
 	}
 
-	// Apply variables to system prompt if present
-	if p.System != nil {
-		systemPrompt := *p.System
-		for key, value := range vars {
-			systemPrompt = strings.ReplaceAll(systemPrompt, fmt.Sprintf("{{%s}}", key), value)
-		}
-		reqBody.System = &systemPrompt
+	rendered, err := renderPrompt(p, vars)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error rendering prompt: %w", err)
 	}
 
-	// Apply variables to initial messages if present
-	if p.InitialUser != nil {
-		userPrompt := *p.InitialUser
-		for key, value := range vars {
-			userPrompt = strings.ReplaceAll(userPrompt, fmt.Sprintf("{{%s}}", key), value)
-		}
+	reqBody.System = rendered.System
+	if rendered.InitialUser != nil {
 		reqBody.Messages = append(reqBody.Messages, messageParam{
 			Role:    "user",
-			Content: userPrompt,
+			Content: *rendered.InitialUser,
 		})
 	}
-	if p.InitialAgent != nil {
-		agentPrompt := *p.InitialAgent
-		for key, value := range vars {
-			agentPrompt = strings.ReplaceAll(agentPrompt, fmt.Sprintf("{{%s}}", key), value)
-		}
+	if rendered.InitialAgent != nil {
 		reqBody.Messages = append(reqBody.Messages, messageParam{
 			Role:    "assistant",
-			Content: agentPrompt,
+			Content: *rendered.InitialAgent,
 		})
 	}
 
@@ -133,7 +138,7 @@ func buildRequest(p *PromptDeclaration, vars PromptVariables) (*anthropicRequest
 	return &reqBody, jsonBody, nil
 }
 
-func buildContinueRequest(vars PromptVariables) (*anthropicRequest, []byte, error) {
+func buildContinueRequest(p *PromptDeclaration, vars PromptVariables) (*anthropicRequest, []byte, error) {
 	var reqBody anthropicRequest
 
 	context, ok := vars["CONTEXT"]
@@ -160,58 +165,188 @@ func buildContinueRequest(vars PromptVariables) (*anthropicRequest, []byte, erro
 	return &reqBody, jsonBody, nil
 }
 
-func sendToAntrhopic(reqBody *anthropicRequest, jsonBody []byte) (interface{}, string, error) {
-	client := &http.Client{}
+func postToAnthropic(p *PromptDeclaration, jsonBody []byte) (*http.Response, error) {
 	req, err := http.NewRequest("POST", anthropicMessageEndpoint, bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return nil, "", fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
-	req.Header.Set("x-api-key", os.Getenv("ANTHROPIC_API_KEY"))
+	req.Header.Set("x-api-key", p.apiKey("ANTHROPIC_API_KEY"))
 	req.Header.Set("anthropic-version", anthropicVersion)
 	req.Header.Set("content-type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := providerClient.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("error making request: %w", err)
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	return resp, nil
+}
+
+func sendToAntrhopic(p *PromptDeclaration, reqBody *anthropicRequest, jsonBody []byte) (interface{}, string, *TokenUsage, error) {
+	resp, err := postToAnthropic(p, jsonBody)
+	if err != nil {
+		return nil, "", nil, err
 	}
 	defer resp.Body.Close()
 
 	return packageResult(resp, reqBody)
 }
 
-func AnthropicProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, error) {
+func streamToAnthropic(p *PromptDeclaration, reqBody *anthropicRequest, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	jsonBody, err := json.Marshal(anthropicStreamRequest{anthropicRequest: *reqBody, Stream: true})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	resp, err := postToAnthropic(p, jsonBody)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close()
+
+	// Errors raised before the stream opens come back as a plain JSON body
+	if !strings.HasPrefix(resp.Header.Get("content-type"), "text/event-stream") {
+		return packageResult(resp, reqBody)
+	}
+	return packageStreamResult(resp.Body, reqBody, onDelta)
+}
+
+// packageStreamResult consumes a Messages API event stream, forwarding text
+// deltas as they arrive, and folds the complete reply into the request the
+// same way packageResult does.
+func packageStreamResult(body io.Reader, reqBody *anthropicRequest, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	var anthResponse anthropicResponse
+	var text strings.Builder
+	stopped := false
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for !stopped && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[len("data:"):])), &event); err != nil {
+			return nil, "", nil, fmt.Errorf("error decoding stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				anthResponse = *event.Message
+			}
+		case "content_block_delta":
+			if event.Delta.Type != "text_delta" {
+				continue
+			}
+			text.WriteString(event.Delta.Text)
+			if err := onDelta(event.Delta.Text); err != nil {
+				return nil, "", nil, fmt.Errorf("error forwarding delta: %w", err)
+			}
+		case "message_delta":
+			anthResponse.StopReason = event.Delta.StopReason
+			if event.Usage != nil {
+				if anthResponse.Usage == nil {
+					anthResponse.Usage = &anthropicUsage{}
+				}
+				anthResponse.Usage.OutputTokens = event.Usage.OutputTokens
+			}
+		case "message_stop":
+			stopped = true
+		case "error":
+			if event.Error != nil {
+				return nil, "", nil, fmt.Errorf("API error: %s", event.Error.Message)
+			}
+			return nil, "", nil, fmt.Errorf("API error in stream")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", nil, fmt.Errorf("error reading stream: %w", err)
+	}
+	if !stopped {
+		return nil, "", nil, fmt.Errorf("stream ended before message_stop")
+	}
+	if text.Len() == 0 {
+		return nil, "", nil, fmt.Errorf("no content in response")
+	}
+
+	anthResponse.Content = []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}{{Type: "text", Text: text.String()}}
+
+	cont := backfillReponse(reqBody, anthResponse)
+	result := collectLatestResponses(cont)
+
+	return *cont, result, anthResponse.Usage.tokenUsage(), nil
+}
+
+func AnthropicProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
 	reqBody, jsonBody, err := buildRequest(p, vars)
 	if err != nil {
-		return nil, "", fmt.Errorf("error creating request content: %w", err)
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToAntrhopic(p, reqBody, jsonBody)
+}
+
+func AnthropicContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	reqBody, jsonBody, err := buildContinueRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToAntrhopic(p, reqBody, jsonBody)
+}
+
+func AnthropicProcessPromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	reqBody, _, err := buildRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
 	}
-	return sendToAntrhopic(reqBody, jsonBody)
+	return streamToAnthropic(p, reqBody, onDelta)
 }
 
-func AnthropicContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, error) {
-	reqBody, jsonBody, err := buildContinueRequest(vars)
+func AnthropicContinuePromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	reqBody, _, err := buildContinueRequest(p, vars)
 	if err != nil {
-		return nil, "", fmt.Errorf("error creating request content: %w", err)
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
 	}
-	return sendToAntrhopic(reqBody, jsonBody)
+	return streamToAnthropic(p, reqBody, onDelta)
+}
+
+type anthropicProvider struct{}
+
+func (anthropicProvider) ProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	return AnthropicProcessPrompt(p, vars)
+}
+
+func (anthropicProvider) ContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	return AnthropicContinuePrompt(p, vars)
+}
+
+func (anthropicProvider) ProcessPromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	return AnthropicProcessPromptStream(p, vars, onDelta)
+}
+
+func (anthropicProvider) ContinuePromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	return AnthropicContinuePromptStream(p, vars, onDelta)
 }
 
-func packageResult(resp *http.Response, reqBody *anthropicRequest) (interface{}, string, error) {
+func packageResult(resp *http.Response, reqBody *anthropicRequest) (interface{}, string, *TokenUsage, error) {
 	var anthResponse anthropicResponse
 	if err := json.NewDecoder(resp.Body).Decode(&anthResponse); err != nil {
-		return nil, "", fmt.Errorf("error decoding response: %w", err)
+		return nil, "", nil, fmt.Errorf("error decoding response: %w", err)
 	}
 
 	if anthResponse.Error != nil {
-		return nil, "", fmt.Errorf("API error: %s", anthResponse.Error.Message)
+		return nil, "", nil, fmt.Errorf("API error: %s", anthResponse.Error.Message)
 	}
 
 	if len(anthResponse.Content) == 0 {
-		return nil, "", fmt.Errorf("no content in response")
+		return nil, "", nil, fmt.Errorf("no content in response")
 	}
 
 	cont := backfillReponse(reqBody, anthResponse)
 	result := collectLatestResponses(cont)
 
-	return *cont, result, nil
+	return *cont, result, anthResponse.Usage.tokenUsage(), nil
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -246,7 +249,7 @@ func TestPackageResult(t *testing.T) {
 				},
 			}
 
-			_, result, err := packageResult(resp, reqBody)
+			_, result, _, err := packageResult(resp, reqBody)
 			if tt.wantErr {
 				assert.Error(t, err)
 				return
@@ -256,3 +259,135 @@ func TestPackageResult(t *testing.T) {
 		})
 	}
 }
+
+func TestAnthropicProcessPromptStream(t *testing.T) {
+	events := []string{
+		`event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: ping
+data: {"type":"ping"}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+		`event: content_block_stop
+data: {"type":"content_block_stop","index":0}`,
+		`event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":5}}`,
+		`event: message_stop
+data: {"type":"message_stop"}`,
+	}
+
+	tests := []struct {
+		name       string
+		events     []string
+		wantErr    bool
+		wantDeltas []string
+	}{
+		{
+			name:       "complete stream",
+			events:     events,
+			wantDeltas: []string{"Hello", " world"},
+		},
+		{
+			name:       "stream cut short",
+			events:     events[:4],
+			wantErr:    true,
+			wantDeltas: []string{"Hello"},
+		},
+		{
+			name: "error event",
+			events: []string{
+				events[0],
+				`event: error
+data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received map[string]interface{}
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+				w.Header().Set("content-type", "text/event-stream")
+				for _, event := range tt.events {
+					fmt.Fprintf(w, "%s\n\n", event)
+				}
+			}))
+			defer mockServer.Close()
+
+			originalEndpoint := anthropicMessageEndpoint
+			anthropicMessageEndpoint = mockServer.URL
+			defer func() { anthropicMessageEndpoint = originalEndpoint }()
+
+			p := &PromptDeclaration{
+				Model:       "claude-3",
+				MaxTokens:   100,
+				InitialUser: stringPtr("Hi"),
+			}
+			var deltas []string
+			modelContext, result, usage, err := AnthropicProcessPromptStream(p, PromptVariables{}, func(text string) error {
+				deltas = append(deltas, text)
+				return nil
+			})
+			assert.Equal(t, true, received["stream"])
+			assert.Equal(t, tt.wantDeltas, deltas)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "Hello world", result)
+			assert.Equal(t, &TokenUsage{InputTokens: 12, OutputTokens: 5}, usage)
+			req := modelContext.(anthropicRequest)
+			assert.Equal(t, "assistant", req.Messages[len(req.Messages)-1].Role)
+			assert.Equal(t, "Hello world", req.Messages[len(req.Messages)-1].Content)
+		})
+	}
+}
+
+func TestAnthropicStreamRequestError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`))
+	}))
+	defer mockServer.Close()
+
+	originalEndpoint := anthropicMessageEndpoint
+	anthropicMessageEndpoint = mockServer.URL
+	defer func() { anthropicMessageEndpoint = originalEndpoint }()
+
+	p := &PromptDeclaration{Model: "claude-3", MaxTokens: 100, InitialUser: stringPtr("Hi")}
+	_, _, _, err := AnthropicProcessPromptStream(p, PromptVariables{}, func(string) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestAnthropicContinuePromptStream(t *testing.T) {
+	var received anthropicRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("content-type", "text/event-stream")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Fine\"}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer mockServer.Close()
+
+	originalEndpoint := anthropicMessageEndpoint
+	anthropicMessageEndpoint = mockServer.URL
+	defer func() { anthropicMessageEndpoint = originalEndpoint }()
+
+	vars := PromptVariables{
+		"CONTEXT":   `{"model":"claude-3","max_tokens":100,"messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello"}]}`,
+		"USER_TEXT": "How are you?",
+	}
+	modelContext, result, _, err := AnthropicContinuePromptStream(&PromptDeclaration{}, vars, func(string) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "Fine", result)
+	assert.Equal(t, 3, len(received.Messages))
+	assert.Equal(t, 4, len(modelContext.(anthropicRequest).Messages))
+}
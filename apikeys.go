@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyPrincipalPrefix starts the user an API key acts as, keeping key IDs
+// apart from token user_ids in credits, contexts and limits. Tokens whose
+// user_id carries it are refused.
+const apiKeyPrincipalPrefix = "apikey:"
+
+// APIKey is a server-to-server credential. Only the SHA-256 of the key is
+// configured, so the config itself never holds a usable secret.
+type APIKey struct {
+	ID        string   `json:"id"`
+	KeySHA256 string   `json:"key_sha256"`
+	Scopes    []string `json:"scopes"`
+}
+
+// apiKeys is indexed by the lowercase hex digest of the key.
+var apiKeys map[string]APIKey
+
+func init() {
+	keys, err := parseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		panic(fmt.Sprintf("API_KEYS invalid: %v", err))
+	}
+	apiKeys = keys
+}
+
+func parseAPIKeys(config string) (map[string]APIKey, error) {
+	keys := make(map[string]APIKey)
+	if config == "" {
+		return keys, nil
+	}
+	var declared []APIKey
+	if err := json.Unmarshal([]byte(config), &declared); err != nil {
+		return nil, err
+	}
+	for _, k := range declared {
+		if k.ID == "" {
+			return nil, fmt.Errorf("api key without id")
+		}
+		digest := strings.ToLower(k.KeySHA256)
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: key_sha256 must be a hex SHA-256 digest", k.ID)
+		}
+		if _, ok := keys[digest]; ok {
+			return nil, fmt.Errorf("api key %s: duplicate key", k.ID)
+		}
+		keys[digest] = k
+	}
+	return keys, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyClaims maps a key to the same claims a token would carry, so scope
+// checks and the user_id lookup are shared with JWT callers. The user_id is
+// the key's id under apiKeyPrincipalPrefix.
+func apiKeyClaims(key string) (map[string]interface{}, bool) {
+	k, ok := apiKeys[hashAPIKey(key)]
+	if !ok {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"user_id": apiKeyPrincipalPrefix + k.ID,
+		"scopes":  strings.Join(k.Scopes, " "),
+	}, true
+}
+
+// authenticate reads claims from an API key when one is presented and from
+// the bearer token otherwise. It writes the error response on failure.
+func authenticate(w http.ResponseWriter, r *http.Request) map[string]interface{} {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		claims := validateAndGetClaims(w, r)
+		if uid, _ := claims["user_id"].(string); strings.HasPrefix(uid, apiKeyPrincipalPrefix) {
+			fmt.Printf("Token user_id %s is reserved for API keys\n", uid)
+			writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInvalidToken, Message: "token user_id is reserved for API keys"})
+			return nil
+		}
+		return claims
+	}
+	claims, ok := apiKeyClaims(key)
+	if !ok {
+		fmt.Printf("Unknown API key\n")
+		writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInvalidAPIKey, Message: "api key is not valid"})
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	digest := hashAPIKey("secret")
+	tests := []struct {
+		name    string
+		config  string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "unset", config: "", wantLen: 0},
+		{name: "one key", config: `[{"id": "nightly", "key_sha256": "` + digest + `", "scopes": ["hello"]}]`, wantLen: 1},
+		{name: "missing id", config: `[{"key_sha256": "` + digest + `"}]`, wantErr: true},
+		{name: "not a digest", config: `[{"id": "nightly", "key_sha256": "secret"}]`, wantErr: true},
+		{name: "duplicate", config: `[{"id": "a", "key_sha256": "` + digest + `"}, {"id": "b", "key_sha256": "` + digest + `"}]`, wantErr: true},
+		{name: "bad json", config: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseAPIKeys(tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLen, len(keys))
+		})
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	apiKeys = map[string]APIKey{
+		hashAPIKey("secret"): {ID: "nightly-job", Scopes: []string{"hello", "goodbye"}},
+	}
+	defer func() { apiKeys = nil }()
+
+	tests := []struct {
+		name       string
+		key        string
+		scope      string
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "valid key", key: "secret", scope: "goodbye", wantStatus: http.StatusOK, wantUser: "apikey:nightly-job"},
+		{name: "unknown key", key: "guess", scope: "hello", wantStatus: http.StatusUnauthorized},
+		{name: "missing scope", key: "secret", scope: "seeya", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user = r.Context().Value(AuthenticatedUserKey).(string)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set(apiKeyHeader, tt.key)
+			w := httptest.NewRecorder()
+			NewTokenMiddleware(handler, tt.scope).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantUser, user)
+		})
+	}
+}
+
+func TestTokenCannotClaimAPIKeyPrincipal(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+	useTokenValidationURL(t, mockServer.URL)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran for a token posing as an API key")
+	})
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"user_id":"apikey:nightly-job","scopes":"hello"}`))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("authorization", "Bearer e30."+payload+".sig")
+	w := httptest.NewRecorder()
+	NewTokenMiddleware(handler, "hello").ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), string(ErrInvalidToken))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxJSONBodySize matches the limit net/http applies to form bodies.
+const maxJSONBodySize = 10 << 20
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// jsonFormValue converts a JSON scalar to the string a form field would carry.
+func jsonFormValue(raw json.RawMessage) (string, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case json.Number:
+		return v.String(), true, nil
+	case bool:
+		return strconv.FormatBool(v), true, nil
+	}
+	return "", false, fmt.Errorf("must be a string, number or boolean")
+}
+
+// parseRequestBody lets JSON bodies stand in for form encoding. A JSON
+// object's top level scalars and the entries of its "variables" object are
+// loaded into r.Form, so FormValue works the same for either encoding.
+// Form bodies are left to net/http. It is safe to call more than once.
+func parseRequestBody(r *http.Request) error {
+	if r.Form != nil || !isJSONRequest(r) {
+		return nil
+	}
+
+	var body map[string]json.RawMessage
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxJSONBodySize))
+	if err := decoder.Decode(&body); err != nil {
+		return fmt.Errorf("decoding JSON body: %w", err)
+	}
+
+	form := make(url.Values)
+	for key, raw := range body {
+		if key == "variables" {
+			continue
+		}
+		value, ok, err := jsonFormValue(raw)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", key, err)
+		}
+		if ok {
+			form.Set(key, value)
+		}
+	}
+	if raw, ok := body["variables"]; ok {
+		var variables map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &variables); err != nil {
+			return fmt.Errorf("variables must be an object")
+		}
+		for key, rawValue := range variables {
+			value, ok, err := jsonFormValue(rawValue)
+			if err != nil {
+				return fmt.Errorf("variable %s: %w", key, err)
+			}
+			if ok {
+				form.Set(key, value)
+			}
+		}
+	}
+
+	r.PostForm = form
+	r.Form = make(url.Values, len(form))
+	for key, values := range form {
+		r.Form[key] = values
+	}
+	for key, values := range r.URL.Query() {
+		if _, ok := r.Form[key]; !ok {
+			r.Form[key] = values
+		}
+	}
+	return nil
+}
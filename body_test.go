@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func createJSONRequest(body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("content-type", "application/json; charset=utf-8")
+	return r
+}
+
+func TestParseRequestBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantErr  bool
+		wantForm map[string]string
+	}{
+		{
+			name: "variables object",
+			body: `{"variables": {"NAME": "Ann", "AGE": 42, "FORMAL": true, "SKIP": null}}`,
+			wantForm: map[string]string{
+				"NAME":   "Ann",
+				"AGE":    "42",
+				"FORMAL": "true",
+				"SKIP":   "",
+				"stream": "true",
+			},
+		},
+		{
+			name: "continuation fields",
+			body: `{"CONTEXT": "abc==", "USER_TEXT": "line one\nline two"}`,
+			wantForm: map[string]string{
+				"CONTEXT":   "abc==",
+				"USER_TEXT": "line one\nline two",
+			},
+		},
+		{
+			name:    "malformed JSON",
+			body:    `{"variables": `,
+			wantErr: true,
+		},
+		{
+			name:    "variables not an object",
+			body:    `{"variables": ["NAME"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "nested value",
+			body:    `{"variables": {"NAME": {"first": "Ann"}}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := createJSONRequest(tt.body)
+			r.URL.RawQuery = "stream=true"
+			err := parseRequestBody(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for k, v := range tt.wantForm {
+				assert.Equal(t, v, r.FormValue(k), k)
+			}
+		})
+	}
+}
+
+func TestParseRequestBodyLeavesFormsAlone(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("NAME=Ann"))
+	r.Header.Set("content-type", "application/x-www-form-urlencoded")
+	assert.NoError(t, parseRequestBody(r))
+	assert.Equal(t, "Ann", r.FormValue("NAME"))
+}
+
+func TestJSONPromptRequest(t *testing.T) {
+	const fakeService = ServiceType("fake")
+	fake := &fakeProvider{}
+	RegisterProvider(fakeService, fake)
+	defer delete(providers, fakeService)
+
+	p := PromptDeclaration{
+		Service:   fakeService,
+		Cost:      fcs.ChargeData{Path: "test/path"},
+		Variables: []VariableDeclaration{{Name: "NAME", Required: true}},
+	}
+
+	req := createJSONRequest(`{"variables": {"NAME": "bob"}}`)
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+	w := httptest.NewRecorder()
+	constructPromptHandler("fake", &p).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "processed bob", resp.Result)
+
+	req = createJSONRequest(`{"variables": `)
+	w = httptest.NewRecorder()
+	constructPromptHandler("fake", &p).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestJSONContinuanceVariables(t *testing.T) {
+	r := createJSONRequest(`{"CONTEXT": "ctx", "USER_TEXT": "hello"}`)
+	assert.NoError(t, parseRequestBody(r))
+	vars := CollectContinuanceVariables(r)
+	assert.Equal(t, PromptVariables{"CONTEXT": "ctx", "USER_TEXT": "hello"}, vars)
+}
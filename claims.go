@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// claimsVariable is the template namespace for exposed token claims, e.g.
+// {{claims.locale}}. Variable names may not contain a dot, and the name
+// itself is rejected, so request variables can never collide with it.
+const claimsVariable = "claims"
+
+var AuthenticatedClaimsKey = contextKey("claims")
+
+func authenticatedClaims(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(AuthenticatedClaimsKey).(map[string]interface{})
+	return claims
+}
+
+// claimValue renders a scalar claim as text. Objects and arrays are not
+// exposed.
+func claimValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+// addClaimVariables copies the prompt's exposed claims into vars as
+// claims.<name>. Claims missing from the token are set to "" so templates
+// never fail on them.
+func addClaimVariables(vars PromptVariables, p *PromptDeclaration, claims map[string]interface{}) {
+	for _, name := range p.ExposedClaims {
+		vars[claimsVariable+"."+name] = claimValue(claims[name])
+	}
+}
+
+func validateExposedClaims(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !variableName.MatchString(name) {
+			return fmt.Errorf("claim name %q must be an identifier", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("claim %s exposed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// splitClaimVariable reports whether a variable key holds an exposed claim
+// and returns the claim's name.
+func splitClaimVariable(key string) (string, bool) {
+	return strings.CutPrefix(key, claimsVariable+".")
+}
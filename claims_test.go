@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func TestValidateExposedClaimTemplates(t *testing.T) {
+	allowed := map[string]bool{"NAME": true, "claims.locale": true}
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{name: "legacy placeholder", text: "Reply in {{claims.locale}}"},
+		{name: "dot syntax", text: "Reply in {{.claims.locale}} to {{.NAME}}"},
+		{name: "root variable", text: "{{range .NAME}}{{$.claims.locale}}{{end}}"},
+		{name: "not exposed", text: "{{claims.email}}", wantErr: true},
+		{name: "whole map", text: "{{.claims}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePromptTemplate(tt.text, allowed)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	assert.Error(t, validateExposedClaims([]string{"locale", "locale"}))
+	assert.Error(t, validateExposedClaims([]string{"https://example.com/role"}))
+	assert.NoError(t, validateExposedClaims([]string{"locale", "display_name"}))
+
+	// a request variable named claims would hide the exposed claims
+	assert.False(t, ValidatePromptDeclartion("shadow", &PromptDeclaration{
+		Service:       Anthropic,
+		Model:         "claude-3",
+		MaxTokens:     100,
+		System:        stringPtr("Hi {{claims}} {{claims.locale}}"),
+		Cost:          fcs.ChargeData{Path: "test/path"},
+		Variables:     []VariableDeclaration{{Name: "claims"}},
+		ExposedClaims: []string{"locale"},
+		RequiredScope: "hello",
+	}))
+}
+
+func TestClaimsRenderedIntoPrompt(t *testing.T) {
+	const claimService = ServiceType("claims")
+	RegisterProvider(claimService, ExecutorProvider{
+		Process: func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+			rendered, err := renderPrompt(p, vars)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			return nil, *rendered.System, nil, nil
+		},
+	})
+	defer delete(providers, claimService)
+
+	system := "Hi {{claims.display_name}}, answer {{NAME}} in {{claims.locale}}{{if .claims.age}} for age {{.claims.age}}{{end}}."
+	p := PromptDeclaration{
+		Service:       claimService,
+		System:        &system,
+		Cost:          fcs.ChargeData{Path: "test/path"},
+		Variables:     []VariableDeclaration{{Name: "NAME"}},
+		ExposedClaims: []string{"display_name", "locale", "age"},
+	}
+
+	tests := []struct {
+		name   string
+		vars   map[string]string
+		claims map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "claims present",
+			vars:   map[string]string{"NAME": "bob"},
+			claims: map[string]interface{}{"display_name": "Ann", "locale": "fr", "age": float64(42), "email": "ann@example.com"},
+			want:   "Hi Ann, answer bob in fr for age 42.",
+		},
+		{
+			name:   "claims missing",
+			vars:   map[string]string{"NAME": "bob"},
+			claims: map[string]interface{}{"user_id": "user1"},
+			want:   "Hi , answer bob in .",
+		},
+		{
+			name:   "client cannot supply claims",
+			vars:   map[string]string{"NAME": "bob", "claims.locale": "de"},
+			claims: map[string]interface{}{"locale": "fr"},
+			want:   "Hi , answer bob in fr.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(tt.vars)
+			ctx := context.WithValue(req.Context(), AuthenticatedUserKey, "user1")
+			ctx = context.WithValue(ctx, AuthenticatedClaimsKey, tt.claims)
+			w := httptest.NewRecorder()
+			constructPromptHandler("claims", &p).ServeHTTP(w, req.WithContext(ctx))
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp Response
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.want, resp.Result)
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A continuation context is base64 of a clear header followed by the sealed
+// payload, except for version 0. The header starts with the envelope version
+// and carries what /v1/continue needs before the caller is authenticated,
+// chiefly the prompt name; GCM still rejects the blob if any of it is
+// altered.
+//
+// Version 0: no header, gzip(JSON PromptContext) sealed with CONTEXT_KEY and
+// no AAD. These predate binding, so they open for anyone holding them and are
+// only accepted until UNVERSIONED_CONTEXTS_UNTIL.
+//
+// Version 1: [1][uvarint len][prompt], sealed with AAD user "\x00" prompt,
+// payload gzip(JSON PromptContext).
+//
+// Version 2: [2][compression][uvarint len][prompt], sealed with AAD header
+// followed by user, payload JSON PromptContext compressed as the header says.
+const (
+	contextEnvelopeV1      byte = 1
+	contextEnvelopeV2      byte = 2
+	currentContextEnvelope      = contextEnvelopeV2
+)
+
+// currentContextVersion is PromptContext.Version for newly sealed payloads.
+// Payloads from version 1 envelopes have no version and no provider.
+const currentContextVersion = 2
+
+// Payload compression used by version 2 envelopes.
+const (
+	contextUncompressed byte = 0
+	contextGzip         byte = 1
+)
+
+// maxContextPayload bounds a decompressed payload.
+const maxContextPayload = 16 << 20
+
+// errContextNotBound means a context did not open for this user and prompt,
+// either because it was issued to someone else or was tampered with.
+var errContextNotBound = errors.New("context not issued to this user")
+
+var errContextExpired = errors.New("context expired")
+
+// errContextOutdated means a version 0 context arrived after its grace
+// window closed.
+var errContextOutdated = errors.New("unversioned context no longer accepted")
+
+// unversionedContextsUntil ends the grace window for version 0 contexts. The
+// zero time refuses them outright.
+var unversionedContextsUntil time.Time
+
+func init() {
+	until := os.Getenv("UNVERSIONED_CONTEXTS_UNTIL")
+	if until == "" {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		panic(fmt.Sprintf("UNVERSIONED_CONTEXTS_UNTIL must be an RFC 3339 time: %v", err))
+	}
+	unversionedContextsUntil = t
+}
+
+// ContextIssuedAtKey carries a continued conversation's start time.
+var ContextIssuedAtKey = contextKey("context_issued_at")
+
+// contextClock is swapped in tests.
+var contextClock = time.Now
+
+type contextHeader struct {
+	version     byte
+	compression byte
+	prompt      string
+	raw         []byte
+}
+
+func (h *contextHeader) aad(user string) []byte {
+	if h.version == contextEnvelopeV1 {
+		return []byte(user + "\x00" + h.prompt)
+	}
+	aad := make([]byte, 0, len(h.raw)+len(user))
+	aad = append(aad, h.raw...)
+	return append(aad, user...)
+}
+
+func encodeContextHeader(compression byte, prompt string) []byte {
+	header := []byte{currentContextEnvelope, compression}
+	header = binary.AppendUvarint(header, uint64(len(prompt)))
+	return append(header, prompt...)
+}
+
+func compressContext(c []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = zw.Write(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressContext(compression byte, payload []byte) ([]byte, error) {
+	switch compression {
+	case contextUncompressed:
+		return payload, nil
+	case contextGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip reader: %v", err)
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, maxContextPayload))
+	}
+	return nil, fmt.Errorf("unknown context compression %d", compression)
+}
+
+// MakeResult seals c, a JSON PromptContext, for user and prompt.
+func MakeResult(user string, prompt string, c []byte, r string) (*Response, error) {
+	compressed, err := compressContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	header := encodeContextHeader(contextGzip, prompt)
+	h := contextHeader{version: currentContextEnvelope, compression: contextGzip, prompt: prompt, raw: header}
+	encrypted, err := EncryptWithAAD(compressed, h.aad(user))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		Context: base64.StdEncoding.EncodeToString(append(header, encrypted...)),
+		Result:  r,
+	}, nil
+}
+
+// splitContext decodes a context and separates the clear header from the
+// sealed payload.
+func splitContext(contextb64 string) (*contextHeader, []byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(contextb64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding CONTEXT %v", err)
+	}
+	if len(blob) == 0 {
+		return nil, nil, fmt.Errorf("unsupported context format")
+	}
+
+	h := contextHeader{version: blob[0], compression: contextGzip}
+	pos := 1
+	switch h.version {
+	case contextEnvelopeV1:
+	case contextEnvelopeV2:
+		if len(blob) < 2 {
+			return nil, nil, fmt.Errorf("context header malformed")
+		}
+		h.compression = blob[1]
+		pos = 2
+	default:
+		return nil, nil, fmt.Errorf("unsupported context format")
+	}
+
+	nameLen, n := binary.Uvarint(blob[pos:])
+	if n <= 0 || nameLen > uint64(len(blob)-pos-n) {
+		return nil, nil, fmt.Errorf("context header malformed")
+	}
+	start := pos + n
+	end := start + int(nameLen)
+	h.prompt = string(blob[start:end])
+	h.raw = blob[:end]
+	return &h, blob[end:], nil
+}
+
+// openUnversionedContext opens a version 0 context. Their first byte is
+// random nonce, which may look like a version, so any blob that opens with
+// CONTEXT_KEY and no AAD is taken to be one whatever it starts with.
+func openUnversionedContext(contextb64 string) (*PromptContext, bool) {
+	if contextKeys.legacy == nil {
+		return nil, false
+	}
+	blob, err := base64.StdEncoding.DecodeString(contextb64)
+	if err != nil {
+		return nil, false
+	}
+	decrypted, err := openWith(contextKeys.legacy, blob, nil)
+	if err != nil {
+		return nil, false
+	}
+	payload, err := decompressContext(contextGzip, decrypted)
+	if err != nil {
+		return nil, false
+	}
+	var pc PromptContext
+	if err := json.Unmarshal(payload, &pc); err != nil {
+		return nil, false
+	}
+	return &pc, true
+}
+
+// PeekContextPrompt returns the prompt a context claims to belong to. The
+// name is not authenticated until UnpackContext succeeds.
+func PeekContextPrompt(contextb64 string) (string, error) {
+	if pc, ok := openUnversionedContext(contextb64); ok {
+		return pc.Prompt, nil
+	}
+	h, _, err := splitContext(contextb64)
+	if err != nil {
+		return "", err
+	}
+	return h.prompt, nil
+}
+
+// legacyContextProvider works out which service wrote a model context that
+// predates the provider field from its shape. Anthropic and OpenAI histories
+// without a system prompt look the same, and read the same under either, so
+// for those it returns "".
+func legacyContextProvider(modelContext json.RawMessage) (ServiceType, error) {
+	var shape struct {
+		Contents json.RawMessage `json:"contents"`
+		System   json.RawMessage `json:"system"`
+		Messages []messageParam  `json:"messages"`
+	}
+	if err := json.Unmarshal(modelContext, &shape); err != nil {
+		return "", fmt.Errorf("decoding model context: %v", err)
+	}
+	switch {
+	case shape.Contents != nil:
+		return Gemini, nil
+	case shape.System != nil:
+		return Anthropic, nil
+	case shape.Messages == nil:
+		return "", fmt.Errorf("model context from an unknown service")
+	}
+	for _, m := range shape.Messages {
+		if m.Role == "system" {
+			return OpenAI, nil
+		}
+	}
+	return "", nil
+}
+
+// migrateContext brings a payload from an older envelope up to the current
+// version. Version 1 payloads did not record their provider, so it is worked
+// out from the model context.
+func migrateContext(pc *PromptContext) error {
+	if pc.Version < currentContextVersion {
+		if pc.Provider == "" {
+			provider, err := legacyContextProvider(pc.ModelContext)
+			if err != nil {
+				return err
+			}
+			pc.Provider = provider
+		}
+		pc.Version = currentContextVersion
+	}
+	return nil
+}
+
+// readableBy reports whether a prompt on service can continue pc. A chat
+// history of unknown origin suits Anthropic and OpenAI alike.
+func (pc *PromptContext) readableBy(service ServiceType) bool {
+	if pc.Provider == "" {
+		return service == Anthropic || service == OpenAI
+	}
+	return pc.Provider == service
+}
+
+// UnpackContext opens a context for user, upgrading older envelope versions.
+// A version 0 context opened during its grace window is reissued bound to
+// user when the conversation continues.
+func UnpackContext(contextb64 string, user string) (*PromptContext, error) {
+	if pc, ok := openUnversionedContext(contextb64); ok {
+		if !contextClock().Before(unversionedContextsUntil) {
+			return nil, errContextOutdated
+		}
+		// only Anthropic prompts could be run before envelope versions
+		pc.Provider = Anthropic
+		if err := migrateContext(pc); err != nil {
+			return nil, err
+		}
+		return pc, nil
+	}
+
+	h, sealed, err := splitContext(contextb64)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := DecryptWithAAD(sealed, h.aad(user))
+	if errors.Is(err, errContextKeyRetired) {
+		return nil, fmt.Errorf("decrypting context: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decrypting context: %w", errContextNotBound)
+	}
+
+	payload, err := decompressContext(h.compression, decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	var pc PromptContext
+	if err := json.Unmarshal(payload, &pc); err != nil {
+		return nil, fmt.Errorf("decoding context JSON: %v", err)
+	}
+	if pc.Version > currentContextVersion {
+		return nil, fmt.Errorf("context version %d is newer than supported", pc.Version)
+	}
+	if pc.Prompt != h.prompt {
+		return nil, fmt.Errorf("context prompt mismatch")
+	}
+	if err := migrateContext(&pc); err != nil {
+		return nil, err
+	}
+	if pc.ExpiresAt != 0 && contextClock().Unix() >= pc.ExpiresAt {
+		return nil, errContextExpired
+	}
+	return &pc, nil
+}
+
+// issuedAt is when the conversation started, or zero if it was not recorded.
+func (pc *PromptContext) issuedAt() time.Time {
+	if pc.IssuedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(pc.IssuedAt, 0)
+}
+
+// newPromptContext stamps a context with its provider, its conversation's
+// start, which a continuation carries forward in ctx, and its expiry under
+// the prompt's current context_ttl.
+func newPromptContext(ctx context.Context, name string, p *PromptDeclaration, modelContext interface{}) (PromptContext, error) {
+	raw, err := json.Marshal(modelContext)
+	if err != nil {
+		return PromptContext{}, fmt.Errorf("marshaling model context: %w", err)
+	}
+	issued, ok := ctx.Value(ContextIssuedAtKey).(time.Time)
+	if !ok || issued.IsZero() {
+		issued = contextClock()
+	}
+	pc := PromptContext{
+		Version:      currentContextVersion,
+		Provider:     p.Service,
+		Prompt:       name,
+		ModelContext: raw,
+		IssuedAt:     issued.Unix(),
+	}
+	if ttl := p.contextTTL(); ttl > 0 {
+		pc.ExpiresAt = issued.Add(ttl).Unix()
+	}
+	return pc, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sealV0Context builds a context the way MakeResult did before envelope
+// versions, with the nonce's first byte chosen so it can pose as a version.
+func sealV0Context(t *testing.T, firstByte byte, prompt string, modelContext interface{}) string {
+	c, _ := json.Marshal(map[string]interface{}{"prompt": prompt, "model_context": modelContext})
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(c)
+	zw.Close()
+
+	aesgcm, err := newGCM(contextKeys.legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	rand.Read(nonce)
+	nonce[0] = firstByte
+	return base64.StdEncoding.EncodeToString(aesgcm.Seal(nonce, nonce, buf.Bytes(), nil))
+}
+
+// sealV1Context builds a context the way version 1 envelopes were written.
+func sealV1Context(t *testing.T, user, prompt, payload string) string {
+	compressed, err := compressContext([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := EncryptWithAAD(compressed, []byte(user+"\x00"+prompt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := []byte{contextEnvelopeV1}
+	blob = binary.AppendUvarint(blob, uint64(len(prompt)))
+	blob = append(blob, prompt...)
+	return base64.StdEncoding.EncodeToString(append(blob, sealed...))
+}
+
+// sealV2Context builds a current envelope with a chosen compression and a raw
+// payload, for payloads MakeResult would not produce.
+func sealV2Context(t *testing.T, user, prompt string, compression byte, payload string) string {
+	data := []byte(payload)
+	if compression == contextGzip {
+		var err error
+		if data, err = compressContext(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := contextHeader{version: contextEnvelopeV2, compression: compression, prompt: prompt, raw: encodeContextHeader(compression, prompt)}
+	sealed, err := EncryptWithAAD(data, h.aad(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(append(h.raw, sealed...))
+}
+
+func TestUnpackContextBinding(t *testing.T) {
+	contextJson, _ := json.Marshal(PromptContext{Version: currentContextVersion, Prompt: "test", ModelContext: json.RawMessage(`{"history":"start"}`)})
+	ret, err := MakeResult("user1", "test", contextJson, "result")
+	if err != nil {
+		t.Fatalf("MakeResult() error = %v", err)
+	}
+
+	if prompt, err := PeekContextPrompt(ret.Context); err != nil || prompt != "test" {
+		t.Errorf("PeekContextPrompt() = %q, %v, want test", prompt, err)
+	}
+	pc, err := UnpackContext(ret.Context, "user1")
+	if err != nil || pc.Prompt != "test" || string(pc.ModelContext) != `{"history":"start"}` {
+		t.Errorf("UnpackContext() = %+v, %v", pc, err)
+	}
+
+	if _, err := UnpackContext(ret.Context, "user2"); !errors.Is(err, errContextNotBound) {
+		t.Errorf("UnpackContext() for another user error = %v, want errContextNotBound", err)
+	}
+
+	// relabelling the blob, or changing its compression, breaks the AAD too
+	blob, _ := base64.StdEncoding.DecodeString(ret.Context)
+	relabelled := append([]byte{}, blob...)
+	copy(relabelled[3:], "best")
+	if _, err := UnpackContext(base64.StdEncoding.EncodeToString(relabelled), "user1"); !errors.Is(err, errContextNotBound) {
+		t.Errorf("UnpackContext() for relabelled prompt error = %v, want errContextNotBound", err)
+	}
+	recompressed := append([]byte{}, blob...)
+	recompressed[1] = contextUncompressed
+	if _, err := UnpackContext(base64.StdEncoding.EncodeToString(recompressed), "user1"); !errors.Is(err, errContextNotBound) {
+		t.Errorf("UnpackContext() for altered compression error = %v, want errContextNotBound", err)
+	}
+
+	// contexts sealed before binding have no header and are refused
+	legacy, _ := Encrypt([]byte("old"))
+	legacy[0] = 0
+	if _, err := PeekContextPrompt(base64.StdEncoding.EncodeToString(legacy)); err == nil {
+		t.Error("PeekContextPrompt() accepted an unbound context")
+	}
+}
+
+func TestUnpackContextVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		context      string
+		wantErr      bool
+		wantProvider ServiceType
+		wantIssued   int64
+		wantModel    string
+	}{
+		{
+			name:         "version 1 envelope",
+			context:      sealV1Context(t, "user1", "test", `{"prompt":"test","model_context":{"system":"Be nice","messages":[]},"issued_at":1700000000}`),
+			wantProvider: Anthropic,
+			wantIssued:   1700000000,
+			wantModel:    `{"system":"Be nice","messages":[]}`,
+		},
+		{
+			name:         "version 1 openai",
+			context:      sealV1Context(t, "user1", "test", `{"prompt":"test","model_context":{"messages":[{"role":"system","content":"Be nice"}]}}`),
+			wantProvider: OpenAI,
+			wantModel:    `{"messages":[{"role":"system","content":"Be nice"}]}`,
+		},
+		{
+			name:         "version 1 gemini",
+			context:      sealV1Context(t, "user1", "test", `{"prompt":"test","model_context":{"contents":[]}}`),
+			wantProvider: Gemini,
+			wantModel:    `{"contents":[]}`,
+		},
+		{
+			name:      "version 1 chat without system prompt",
+			context:   sealV1Context(t, "user1", "test", `{"prompt":"test","model_context":{"messages":[{"role":"user","content":"Hi"}]}}`),
+			wantModel: `{"messages":[{"role":"user","content":"Hi"}]}`,
+		},
+		{
+			name:    "version 1 unknown service",
+			context: sealV1Context(t, "user1", "test", `{"prompt":"test","model_context":{"history":"start"}}`),
+			wantErr: true,
+		},
+		{
+			name:         "version 2 gzip",
+			context:      sealV2Context(t, "user1", "test", contextGzip, `{"v":2,"provider":"anthropic","prompt":"test","model_context":{"history":"start"}}`),
+			wantProvider: Anthropic,
+		},
+		{
+			name:         "version 2 uncompressed",
+			context:      sealV2Context(t, "user1", "test", contextUncompressed, `{"v":2,"provider":"gemini","prompt":"test","model_context":{"history":"start"}}`),
+			wantProvider: Gemini,
+		},
+		{
+			name:    "unknown compression",
+			context: sealV2Context(t, "user1", "test", 9, `{"v":2,"prompt":"test","model_context":{}}`),
+			wantErr: true,
+		},
+		{
+			name:    "newer payload version",
+			context: sealV2Context(t, "user1", "test", contextGzip, `{"v":3,"prompt":"test","model_context":{}}`),
+			wantErr: true,
+		},
+		{
+			name:    "payload for another prompt",
+			context: sealV2Context(t, "user1", "test", contextGzip, `{"v":2,"prompt":"other","model_context":{}}`),
+			wantErr: true,
+		},
+		{
+			name:    "unknown envelope version",
+			context: base64.StdEncoding.EncodeToString([]byte{9, 4, 't', 'e', 's', 't'}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := UnpackContext(tt.context, "user1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnpackContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if pc.Version != currentContextVersion {
+				t.Errorf("UnpackContext() version = %d, want %d", pc.Version, currentContextVersion)
+			}
+			if pc.Provider != tt.wantProvider {
+				t.Errorf("UnpackContext() provider = %q, want %q", pc.Provider, tt.wantProvider)
+			}
+			if pc.IssuedAt != tt.wantIssued {
+				t.Errorf("UnpackContext() issued_at = %d, want %d", pc.IssuedAt, tt.wantIssued)
+			}
+			wantModel := tt.wantModel
+			if wantModel == "" {
+				wantModel = `{"history":"start"}`
+			}
+			if string(pc.ModelContext) != wantModel {
+				t.Errorf("UnpackContext() model context = %s", pc.ModelContext)
+			}
+		})
+	}
+}
+
+func TestUnpackUnversionedContext(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	contextClock = func() time.Time { return now }
+	defer func() { contextClock = time.Now }()
+	defer func() { unversionedContextsUntil = time.Time{} }()
+
+	tests := []struct {
+		name      string
+		firstByte byte
+		until     time.Time
+		wantErr   error
+	}{
+		{name: "in grace window", firstByte: 0x9c, until: now.Add(time.Hour)},
+		{name: "nonce looks like version 1", firstByte: contextEnvelopeV1, until: now.Add(time.Hour)},
+		{name: "nonce looks like version 2", firstByte: contextEnvelopeV2, until: now.Add(time.Hour)},
+		{name: "grace window over", firstByte: contextEnvelopeV2, until: now, wantErr: errContextOutdated},
+		{name: "no grace window", firstByte: 0x9c, wantErr: errContextOutdated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unversionedContextsUntil = tt.until
+			blob := sealV0Context(t, tt.firstByte, "test", map[string]string{"history": "start"})
+
+			if prompt, err := PeekContextPrompt(blob); err != nil || prompt != "test" {
+				t.Errorf("PeekContextPrompt() = %q, %v, want test", prompt, err)
+			}
+			pc, err := UnpackContext(blob, "anyone")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("UnpackContext() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnpackContext() error = %v", err)
+			}
+			if pc.Version != currentContextVersion || pc.Provider != Anthropic || pc.Prompt != "test" {
+				t.Errorf("UnpackContext() = %+v", pc)
+			}
+			if string(pc.ModelContext) != `{"history":"start"}` {
+				t.Errorf("UnpackContext() model context = %s", pc.ModelContext)
+			}
+		})
+	}
+}
+
+func TestContextExpiry(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	contextClock = func() time.Time { return now }
+	defer func() { contextClock = time.Now }()
+
+	p := &PromptDeclaration{Service: Anthropic, ContextTTL: "1h"}
+	pc, err := newPromptContext(context.Background(), "test", p, map[string]string{"history": "start"})
+	if err != nil {
+		t.Fatalf("newPromptContext() error = %v", err)
+	}
+	if pc.IssuedAt != start.Unix() || pc.ExpiresAt != start.Add(time.Hour).Unix() || pc.Provider != Anthropic {
+		t.Errorf("newPromptContext() = %+v", pc)
+	}
+	contextJson, _ := json.Marshal(pc)
+	ret, err := MakeResult("user1", "test", contextJson, "result")
+	if err != nil {
+		t.Fatalf("MakeResult() error = %v", err)
+	}
+
+	now = start.Add(59 * time.Minute)
+	opened, err := UnpackContext(ret.Context, "user1")
+	if err != nil || !opened.issuedAt().Equal(start) {
+		t.Errorf("UnpackContext() before expiry = %+v, %v", opened, err)
+	}
+
+	// a continuation keeps the conversation's start, so its expiry does not slide
+	continued, _ := newPromptContext(context.WithValue(context.Background(), ContextIssuedAtKey, opened.issuedAt()), "test", p, "more")
+	if continued.ExpiresAt != pc.ExpiresAt {
+		t.Errorf("continued context expires %d, want %d", continued.ExpiresAt, pc.ExpiresAt)
+	}
+
+	now = start.Add(time.Hour)
+	if _, err := UnpackContext(ret.Context, "user1"); !errors.Is(err, errContextExpired) {
+		t.Errorf("UnpackContext() after expiry error = %v, want errContextExpired", err)
+	}
+
+	if pc, _ := newPromptContext(context.Background(), "test", &PromptDeclaration{}, "history"); pc.ExpiresAt != 0 {
+		t.Errorf("context without context_ttl expires %d", pc.ExpiresAt)
+	}
+}
+
+func TestUnversionedContextOnMovedPrompt(t *testing.T) {
+	defer func() { unversionedContextsUntil = time.Time{} }()
+	unversionedContextsUntil = time.Now().Add(time.Hour)
+	saved := providers[Anthropic]
+	defer func() { providers[Anthropic] = saved }()
+	RegisterProvider(Anthropic, &fakeProvider{})
+
+	// version 0 contexts only ever came from Anthropic
+	blob := sealV0Context(t, 0x9c, "test", map[string]interface{}{
+		"model":    "claude-3",
+		"messages": []map[string]string{{"role": "user", "content": "Hi"}},
+	})
+
+	tests := []struct {
+		service    ServiceType
+		wantStatus int
+	}{
+		{service: Anthropic, wantStatus: http.StatusOK},
+		{service: OpenAI, wantStatus: http.StatusBadRequest},
+		{service: Gemini, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.service), func(t *testing.T) {
+			p := &PromptDeclaration{Service: tt.service}
+			req := createTestRequest(map[string]string{"USER_TEXT": "again"})
+			req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+			w := httptest.NewRecorder()
+			boundContinuance(blob, p).ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				assert.Contains(t, w.Body.String(), string(ErrInvalidContext))
+			}
+		})
+	}
+}
+
+func TestContextSealedWithRetiredKey(t *testing.T) {
+	saved := contextKeys
+	defer func() { contextKeys = saved }()
+	contextKeys, _ = newKeyring(`{"a": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}`, "a", "")
+	contextJson, _ := json.Marshal(PromptContext{Version: currentContextVersion, Provider: Anthropic, Prompt: "test", ModelContext: json.RawMessage(`{}`)})
+	ret, err := MakeResult("user1", "test", contextJson, "hi")
+	if err != nil {
+		t.Fatalf("MakeResult() error = %v", err)
+	}
+
+	// the key the context names is gone, which is not the owner's fault
+	contextKeys, _ = newKeyring(`{"b": "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}`, "b", "")
+	_, err = UnpackContext(ret.Context, "user1")
+	assert.ErrorIs(t, err, errContextKeyRetired)
+	assert.NotErrorIs(t, err, errContextNotBound)
+
+	req := createTestRequest(map[string]string{"USER_TEXT": "again"})
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+	w := httptest.NewRecorder()
+	boundContinuance(ret.Context, &PromptDeclaration{Service: Anthropic}).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), string(ErrContextKeyRetired))
+
+	// a key that is still held but rejects the caller is a binding failure
+	contextKeys, _ = newKeyring(`{"a": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}`, "a", "")
+	_, err = UnpackContext(ret.Context, "user2")
+	assert.ErrorIs(t, err, errContextNotBound)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// creditsScope is what a caller needs to read its own credits. CREDITS_SCOPE
+// unset lets any authenticated user.
+var creditsScope ScopeExpr
+
+func init() {
+	creditsScope = ScopeExpr{Scope: os.Getenv("CREDITS_SCOPE")}
+}
+
+// CreditBalances is the GET /v1/credits response.
+type CreditBalances struct {
+	Balances map[string]int `json:"balances"` // by cost path
+}
+
+// CreditHistoryPage is the GET /v1/credits/history response.
+type CreditHistoryPage struct {
+	Transactions []CreditTransaction `json:"transactions"`
+	Next         string              `json:"next,omitempty"` // cursor for the following page
+}
+
+// recordCredit adds a transaction to the user's history. A failure is only
+// logged; the balance has already moved.
+func recordCredit(ctx context.Context, ledger CreditLedger, user, kind, path, prompt string, amount int) {
+	tx := CreditTransaction{
+		Kind:      kind,
+		Path:      path,
+		Amount:    amount,
+		Prompt:    prompt,
+		RequestID: requestID(ctx),
+		Timestamp: time.Now().UTC(),
+	}
+	if err := ledger.Record(ctx, user, tx); err != nil {
+		fmt.Printf("Failed to record %s of %d credits for user %s %v\n", kind, amount, user, err)
+	}
+}
+
+// creditPaths lists every cost path the configured prompts charge to.
+func creditPaths(config PromptConfig) []string {
+	seen := make(map[string]bool)
+	for _, p := range config {
+		seen[p.Cost.Path] = true
+		if p.ContinueCost != nil {
+			seen[p.ContinueCost.Path] = true
+		}
+	}
+	delete(seen, "")
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("failed to marshal response: %v\n", err)
+		writeError(ctx, w, http.StatusInternalServerError, APIError{Code: ErrInternal, Message: "could not encode response"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		fmt.Printf("failed to write response: %v\n", err)
+	}
+}
+
+func creditBalances(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(AuthenticatedUserKey).(string)
+	ret := CreditBalances{Balances: make(map[string]int)}
+	for _, path := range creditPaths(prompts) {
+		balance, err := creditLedger.Balance(ctx, path, user)
+		if err != nil {
+			fmt.Printf("Failed to read %s balance for user %s %v\n", path, user, err)
+			writeError(ctx, w, http.StatusInternalServerError, APIError{Code: ErrCreditService, Message: "could not read credits"})
+			return
+		}
+		ret.Balances[path] = balance
+	}
+	writeJSON(ctx, w, ret)
+}
+
+func creditHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(AuthenticatedUserKey).(string)
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			writeError(ctx, w, http.StatusBadRequest, APIError{Code: ErrInvalidParameter, Message: fmt.Sprintf("limit must be 1 to %d", maxHistoryLimit), Field: "limit"})
+			return
+		}
+		limit = n
+	}
+	txs, next, err := creditLedger.History(ctx, user, r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, errInvalidCursor) {
+		writeError(ctx, w, http.StatusBadRequest, APIError{Code: ErrInvalidParameter, Message: err.Error(), Field: "cursor"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to read credit history for user %s %v\n", user, err)
+		writeError(ctx, w, http.StatusInternalServerError, APIError{Code: ErrCreditService, Message: "could not read credit history"})
+		return
+	}
+	if txs == nil {
+		txs = []CreditTransaction{}
+	}
+	writeJSON(ctx, w, CreditHistoryPage{Transactions: txs, Next: next})
+}
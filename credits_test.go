@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func useTestLedger(t *testing.T) *sqliteCreditLedger {
+	t.Helper()
+	ledger, err := openSQLiteCreditLedger(":memory:")
+	if err != nil {
+		t.Fatalf("openSQLiteCreditLedger() error = %v", err)
+	}
+	saved := creditLedger
+	creditLedger = ledger
+	t.Cleanup(func() {
+		creditLedger = saved
+		ledger.Close()
+	})
+	return ledger
+}
+
+func TestCreditPaths(t *testing.T) {
+	config := PromptConfig{
+		"a": {Cost: fcs.ChargeData{Path: "app/credits"}},
+		"b": {Cost: fcs.ChargeData{Path: "app/credits"}, ContinueCost: &fcs.ChargeData{Path: "chat/credits"}},
+		"c": {Cost: fcs.ChargeData{Path: "bonus"}},
+	}
+	assert.Equal(t, []string{"app/credits", "bonus", "chat/credits"}, creditPaths(config))
+}
+
+func TestCreditEndpoints(t *testing.T) {
+	ledger := useTestLedger(t)
+	ctx := context.Background()
+	ledger.AddCredits(ctx, "app/credits", apiKeyPrincipalPrefix+"alice", 7)
+	ledger.AddCredits(ctx, "app/credits", "bob", 100)
+	// a token user named like the key's id is a different account
+	ledger.AddCredits(ctx, "app/credits", "alice", 50)
+
+	saved := prompts
+	prompts = PromptConfig{
+		"a": {Cost: fcs.ChargeData{Path: "app/credits"}},
+		"b": {Cost: fcs.ChargeData{Path: "other/credits"}},
+	}
+	defer func() { prompts = saved }()
+
+	apiKeys = map[string]APIKey{hashAPIKey("alice-key"): {ID: "alice"}}
+	defer func() { apiKeys = nil }()
+
+	for i, kind := range []string{CreditGrant, CreditCharge, CreditRefund} {
+		ledger.Record(ctx, apiKeyPrincipalPrefix+"alice", CreditTransaction{Kind: kind, Path: "app/credits", Amount: i + 1, Prompt: "a", RequestID: "req"})
+	}
+	ledger.Record(ctx, "bob", CreditTransaction{Kind: CreditCharge, Path: "app/credits", Amount: 9})
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(apiKeyHeader, "alice-key")
+		w := httptest.NewRecorder()
+		NewScopedTokenMiddleware(handler, ScopeExpr{}).ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(creditBalances, "/v1/credits")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var balances CreditBalances
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &balances))
+	assert.Equal(t, map[string]int{"app/credits": 7, "other/credits": 0}, balances.Balances)
+	exists, _ := ledger.AccountExists(ctx, "other/credits", apiKeyPrincipalPrefix+"alice")
+	assert.False(t, exists, "reading a balance created an account")
+
+	w = get(creditHistory, "/v1/credits/history?limit=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page CreditHistoryPage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	if assert.Len(t, page.Transactions, 2) {
+		assert.Equal(t, CreditRefund, page.Transactions[0].Kind)
+		assert.Equal(t, CreditCharge, page.Transactions[1].Kind)
+		assert.Equal(t, "a", page.Transactions[0].Prompt)
+		assert.Equal(t, "req", page.Transactions[0].RequestID)
+	}
+	assert.NotEmpty(t, page.Next)
+
+	w = get(creditHistory, "/v1/credits/history?limit=2&cursor="+page.Next)
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = CreditHistoryPage{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	if assert.Len(t, page.Transactions, 1) {
+		assert.Equal(t, CreditGrant, page.Transactions[0].Kind)
+	}
+	assert.Empty(t, page.Next)
+
+	for _, target := range []string{"/v1/credits/history?limit=0", "/v1/credits/history?limit=500", "/v1/credits/history?cursor=abc"} {
+		w = get(creditHistory, target)
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.Contains(t, w.Body.String(), string(ErrInvalidParameter))
+	}
+}
+
+func TestRunFuncRecordsHistory(t *testing.T) {
+	ledger := useTestLedger(t)
+	ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+	ctx = context.WithValue(ctx, RequestIDKey, "req-1")
+
+	p := &PromptDeclaration{
+		Service:            Anthropic,
+		MaxTokens:          10,
+		Cost:               fcs.ChargeData{Path: "app/credits"},
+		Pricing:            &TokenPricing{OutputPer1K: 1000, Reserve: 10},
+		InitialCreditGrant: 20,
+	}
+	executor := func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		return map[string]string{}, "done", &TokenUsage{OutputTokens: 4}, nil
+	}
+	w := httptest.NewRecorder()
+	runFunc(ctx, &p.Cost, "chat", p, PromptVariables{}, executor, nil, w)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	txs, _, err := ledger.History(ctx, "alice", "", 10)
+	assert.NoError(t, err)
+	var got []CreditTransaction
+	for _, tx := range txs {
+		got = append(got, CreditTransaction{Kind: tx.Kind, Path: tx.Path, Amount: tx.Amount, Prompt: tx.Prompt, RequestID: tx.RequestID})
+	}
+	assert.Equal(t, []CreditTransaction{
+		{Kind: CreditRefund, Path: "app/credits", Amount: 6, Prompt: "chat", RequestID: "req-1"},
+		{Kind: CreditCharge, Path: "app/credits", Amount: 10, Prompt: "chat", RequestID: "req-1"},
+		{Kind: CreditGrant, Path: "app/credits", Amount: 20, Prompt: "chat", RequestID: "req-1"},
+	}, got)
+}
+
+func TestRunFuncRecordsUnpaidOverage(t *testing.T) {
+	ledger := useTestLedger(t)
+	ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+	ledger.AddCredits(ctx, "app/credits", "alice", 12)
+
+	p := &PromptDeclaration{
+		Service:   Anthropic,
+		MaxTokens: 10,
+		Cost:      fcs.ChargeData{Path: "app/credits"},
+		Pricing:   &TokenPricing{InputPer1K: 1000, OutputPer1K: 1000, Reserve: 10},
+	}
+	// the prompt ran far longer than estimated and the user has 2 credits left
+	executor := func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		return map[string]string{}, "done", &TokenUsage{InputTokens: 5, OutputTokens: 10}, nil
+	}
+	w := httptest.NewRecorder()
+	runFunc(ctx, &p.Cost, "chat", p, PromptVariables{}, executor, nil, w)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	balance, _ := ledger.Balance(ctx, "app/credits", "alice")
+	assert.Equal(t, 2, balance)
+	txs, _, err := ledger.History(ctx, "alice", "", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, txs, 2) {
+		assert.Equal(t, CreditUnpaid, txs[0].Kind)
+		assert.Equal(t, 5, txs[0].Amount)
+		assert.Equal(t, CreditCharge, txs[1].Kind)
+	}
+}
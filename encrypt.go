@@ -4,50 +4,104 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 )
 
-var (
-	encryptKey []byte
-)
+// keyedEnvelopeMagic starts ciphertext sealed under a named key. It is
+// followed by the ID's length, the ID, the nonce and the sealed data.
+// Ciphertext without it predates the keyring and was sealed with CONTEXT_KEY.
+const keyedEnvelopeMagic byte = 'K'
+
+// keyring holds every key contexts may be opened with. New contexts are
+// sealed with the active key; an empty active ID means the deployment only
+// has CONTEXT_KEY and keeps writing the unprefixed format.
+type keyring struct {
+	active string
+	keys   map[string][]byte
+	legacy []byte
+}
+
+var contextKeys *keyring
+
+// errContextKeyRetired means ciphertext names a key that is no longer in the
+// ring, so it cannot be opened whoever presents it.
+var errContextKeyRetired = errors.New("context key no longer in the keyring")
 
 func init() {
-	key := os.Getenv("CONTEXT_KEY")
-	if len(key) != 32 {
-		panic("CONTEXT_KEY environment variable must be exactly 32 characters")
+	ring, err := newKeyring(os.Getenv("CONTEXT_KEYS"), os.Getenv("CONTEXT_KEY_ID"), os.Getenv("CONTEXT_KEY"))
+	if err != nil {
+		panic(err.Error())
 	}
-	encryptKey = []byte(key)
+	contextKeys = ring
 }
 
-func Encrypt(data []byte) ([]byte, error) {
-	block, err := aes.NewCipher(encryptKey)
-	if err != nil {
-		return nil, err
+// newKeyring builds a keyring from CONTEXT_KEYS, a JSON object of key ID to
+// 32 character key, with CONTEXT_KEY_ID naming the active one. CONTEXT_KEY
+// stays accepted for contexts sealed before key IDs.
+func newKeyring(keysJson, activeID, legacyKey string) (*keyring, error) {
+	if legacyKey != "" && len(legacyKey) != 32 {
+		return nil, fmt.Errorf("CONTEXT_KEY environment variable must be exactly 32 characters")
+	}
+	ring := &keyring{keys: make(map[string][]byte)}
+	if legacyKey != "" {
+		ring.legacy = []byte(legacyKey)
+	}
+	if keysJson == "" {
+		if ring.legacy == nil {
+			return nil, fmt.Errorf("CONTEXT_KEY environment variable must be exactly 32 characters")
+		}
+		return ring, nil
 	}
 
-	nonce := make([]byte, 12) // GCM nonce size
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+	var keys map[string]string
+	if err := json.Unmarshal([]byte(keysJson), &keys); err != nil {
+		return nil, fmt.Errorf("CONTEXT_KEYS must be a JSON object of key ID to key: %v", err)
+	}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("CONTEXT_KEYS key ID %q must be 1 to 255 bytes", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("CONTEXT_KEYS key %s must be exactly 32 characters", id)
+		}
+		ring.keys[id] = []byte(key)
 	}
+	if _, ok := ring.keys[activeID]; !ok {
+		return nil, fmt.Errorf("CONTEXT_KEY_ID must name a key in CONTEXT_KEYS")
+	}
+	ring.active = activeID
+	return ring, nil
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-
-	ciphertext := aesgcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	return cipher.NewGCM(block)
 }
 
-func Decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(encryptKey)
+func sealWith(key []byte, prefix []byte, data []byte, aad []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(prefix, nonce...)
+	return aesgcm.Seal(out, nonce, data, aad), nil
+}
+
+func openWith(key []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -57,10 +111,64 @@ func Decrypt(ciphertext []byte) ([]byte, error) {
 		return nil, fmt.Errorf("data too short")
 	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
+	return aesgcm.Open(nil, nonce, ciphertext, aad)
+}
+
+// splitKeyID separates a keyed envelope into its key ID and the rest.
+func splitKeyID(ciphertext []byte) (string, []byte, bool) {
+	if len(ciphertext) < 2 || ciphertext[0] != keyedEnvelopeMagic {
+		return "", nil, false
+	}
+	idLen := int(ciphertext[1])
+	if idLen == 0 || len(ciphertext) < 2+idLen {
+		return "", nil, false
 	}
+	return string(ciphertext[2 : 2+idLen]), ciphertext[2+idLen:], true
+}
 
-	return plaintext, nil
+func Encrypt(data []byte) ([]byte, error) {
+	return EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD seals data with the active key so that it only opens with
+// the same additional authenticated data.
+func EncryptWithAAD(data []byte, aad []byte) ([]byte, error) {
+	if contextKeys.active == "" {
+		return sealWith(contextKeys.legacy, nil, data, aad)
+	}
+	prefix := []byte{keyedEnvelopeMagic, byte(len(contextKeys.active))}
+	prefix = append(prefix, contextKeys.active...)
+	return sealWith(contextKeys.keys[contextKeys.active], prefix, data, aad)
+}
+
+func Decrypt(ciphertext []byte) ([]byte, error) {
+	return DecryptWithAAD(ciphertext, nil)
+}
+
+// DecryptWithAAD opens data sealed under any key in the ring. Unprefixed
+// data, or data whose prefix was only a coincidence of its random nonce, is
+// tried against CONTEXT_KEY.
+func DecryptWithAAD(ciphertext []byte, aad []byte) ([]byte, error) {
+	var keyedErr error = fmt.Errorf("no key for context")
+	if id, sealed, ok := splitKeyID(ciphertext); ok {
+		if key, known := contextKeys.keys[id]; known {
+			plaintext, err := openWith(key, sealed, aad)
+			if err == nil {
+				return plaintext, nil
+			}
+			keyedErr = err
+		} else {
+			keyedErr = fmt.Errorf("%w: %s", errContextKeyRetired, id)
+		}
+	}
+	if contextKeys.legacy == nil {
+		return nil, keyedErr
+	}
+	plaintext, err := openWith(contextKeys.legacy, ciphertext, aad)
+	// a legacy blob can start with the magic byte by chance, so the retired
+	// key only explains the failure once CONTEXT_KEY has been tried too
+	if err != nil && errors.Is(keyedErr, errContextKeyRetired) {
+		return nil, keyedErr
+	}
+	return plaintext, err
 }
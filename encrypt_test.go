@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -87,3 +88,95 @@ func TestDecryptInvalidData(t *testing.T) {
 		})
 	}
 }
+
+func TestNewKeyring(t *testing.T) {
+	const keyA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	tests := []struct {
+		name     string
+		keysJson string
+		activeID string
+		legacy   string
+		wantErr  bool
+	}{
+		{name: "legacy only", legacy: keyA},
+		{name: "keyring", keysJson: `{"a": "` + keyA + `"}`, activeID: "a"},
+		{name: "keyring with legacy", keysJson: `{"a": "` + keyA + `"}`, activeID: "a", legacy: keyA},
+		{name: "nothing set", wantErr: true},
+		{name: "short legacy", legacy: "short", wantErr: true},
+		{name: "short key", keysJson: `{"a": "short"}`, activeID: "a", wantErr: true},
+		{name: "active missing", keysJson: `{"a": "` + keyA + `"}`, activeID: "b", wantErr: true},
+		{name: "bad json", keysJson: `["a"]`, activeID: "a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newKeyring(tt.keysJson, tt.activeID, tt.legacy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	const (
+		keyA   = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		keyB   = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		legacy = "llllllllllllllllllllllllllllllll"
+	)
+	saved := contextKeys
+	defer func() { contextKeys = saved }()
+
+	seal := func(ring *keyring, data string) []byte {
+		contextKeys = ring
+		sealed, err := EncryptWithAAD([]byte(data), []byte("aad"))
+		if err != nil {
+			t.Fatalf("EncryptWithAAD() error = %v", err)
+		}
+		return sealed
+	}
+
+	legacyRing, _ := newKeyring("", "", legacy)
+	ringA, _ := newKeyring(`{"a": "`+keyA+`"}`, "a", legacy)
+	ringB, _ := newKeyring(`{"a": "`+keyA+`", "b": "`+keyB+`"}`, "b", legacy)
+	ringBOnly, _ := newKeyring(`{"b": "`+keyB+`"}`, "b", "")
+
+	fromLegacy := seal(legacyRing, "legacy")
+	fromA := seal(ringA, "from a")
+	fromB := seal(ringB, "from b")
+	if !bytes.HasPrefix(fromB, []byte{keyedEnvelopeMagic, 1, 'b'}) {
+		t.Errorf("ciphertext prefix = %v, want key ID b", fromB[:3])
+	}
+
+	tests := []struct {
+		name        string
+		ring        *keyring
+		ciphertext  []byte
+		want        string
+		wantErr     bool
+		wantRetired bool
+	}{
+		{name: "retired key still opens", ring: ringB, ciphertext: fromA, want: "from a"},
+		{name: "active key", ring: ringB, ciphertext: fromB, want: "from b"},
+		{name: "legacy blob", ring: ringB, ciphertext: fromLegacy, want: "legacy"},
+		{name: "dropped key", ring: ringBOnly, ciphertext: fromA, wantErr: true, wantRetired: true},
+		{name: "dropped legacy key", ring: ringBOnly, ciphertext: fromLegacy, wantErr: true},
+		{name: "newer key unknown", ring: ringA, ciphertext: fromB, wantErr: true, wantRetired: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contextKeys = tt.ring
+			got, err := DecryptWithAAD(tt.ciphertext, []byte("aad"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecryptWithAAD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errContextKeyRetired) != tt.wantRetired {
+				t.Errorf("DecryptWithAAD() error = %v, want retired %v", err, tt.wantRetired)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("DecryptWithAAD() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
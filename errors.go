@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is a stable machine readable reason carried in error responses.
+type ErrorCode string
+
+const (
+	ErrInvalidBody           ErrorCode = "invalid_body"
+	ErrInvalidVariable       ErrorCode = "invalid_variable"
+	ErrInvalidParameter      ErrorCode = "invalid_parameter"
+	ErrMissingContext        ErrorCode = "missing_context"
+	ErrInvalidContext        ErrorCode = "invalid_context"
+	ErrContextForbidden      ErrorCode = "context_forbidden"
+	ErrContextExpired        ErrorCode = "context_expired"
+	ErrContextOutdated       ErrorCode = "context_outdated"
+	ErrContextKeyRetired     ErrorCode = "context_key_retired"
+	ErrUnknownPrompt         ErrorCode = "unknown_prompt"
+	ErrUnknownConversation   ErrorCode = "unknown_conversation"
+	ErrConversationStore     ErrorCode = "conversation_store_error"
+	ErrMissingToken          ErrorCode = "missing_token"
+	ErrInvalidToken          ErrorCode = "invalid_token"
+	ErrInvalidAPIKey         ErrorCode = "invalid_api_key"
+	ErrInsufficientScope     ErrorCode = "insufficient_scope"
+	ErrInsufficientCredits   ErrorCode = "insufficient_credits"
+	ErrRateLimited           ErrorCode = "rate_limited"
+	ErrCreditService         ErrorCode = "credit_service_error"
+	ErrServiceNotImplemented ErrorCode = "service_not_implemented"
+	ErrUpstream              ErrorCode = "upstream_error"
+	ErrUpstreamTimeout       ErrorCode = "upstream_timeout"
+	ErrInternal              ErrorCode = "internal_error"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var RequestIDKey = contextKey("request_id")
+
+// CreditInfo tells a client how far short of a charge its balance is.
+type CreditInfo struct {
+	Remaining int `json:"remaining"`
+	Required  int `json:"required"`
+}
+
+type APIError struct {
+	Code      ErrorCode   `json:"code"`
+	Message   string      `json:"message"`
+	RequestID string      `json:"request_id"`
+	Field     string      `json:"field,omitempty"`
+	Credits   *CreditInfo `json:"credits,omitempty"`
+}
+
+type errorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts caller supplied IDs that are short and printable so
+// they are safe to echo into headers and logs.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(RequestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// RequestIDMiddleware tags every request with an ID, reusing the caller's
+// X-Request-ID when it is usable, and echoes it in the response.
+type RequestIDMiddleware struct {
+	handler http.Handler
+}
+
+func (m *RequestIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	m.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestIDKey, id)))
+}
+
+func NewRequestIDMiddleware(handlerToWrap http.Handler) *RequestIDMiddleware {
+	return &RequestIDMiddleware{handlerToWrap}
+}
+
+// errorResponse fills in the request ID, generating one for requests that did
+// not pass through RequestIDMiddleware.
+func errorResponse(ctx context.Context, w http.ResponseWriter, apiErr APIError) errorEnvelope {
+	apiErr.RequestID = requestID(ctx)
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = w.Header().Get(requestIDHeader)
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = newRequestID()
+		w.Header().Set(requestIDHeader, apiErr.RequestID)
+	}
+	return errorEnvelope{Error: apiErr}
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, status int, apiErr APIError) {
+	body, err := json.Marshal(errorResponse(ctx, w, apiErr))
+	if err != nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		fmt.Printf("failed to write error response: %v\n", err)
+	}
+}
+
+// upstreamFailure classifies an executor error for the client.
+func upstreamFailure(err error) (int, APIError) {
+	var timeout interface{ Timeout() bool }
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &timeout) && timeout.Timeout()) {
+		return http.StatusGatewayTimeout, APIError{Code: ErrUpstreamTimeout, Message: "model provider timed out"}
+	}
+	return http.StatusBadGateway, APIError{Code: ErrUpstream, Message: "model provider request failed"}
+}
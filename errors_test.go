@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "caller supplied", incoming: "abc-123", wantSame: true},
+		{name: "generated when missing", incoming: ""},
+		{name: "generated when unprintable", incoming: "bad id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := NewRequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestID(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestIDHeader, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.NotEmpty(t, seen)
+			assert.Equal(t, seen, w.Header().Get(requestIDHeader))
+			if tt.wantSame {
+				assert.Equal(t, tt.incoming, seen)
+			} else {
+				assert.NotEqual(t, tt.incoming, seen)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	ctx := context.WithValue(context.Background(), RequestIDKey, "req-1")
+	w := httptest.NewRecorder()
+	writeError(ctx, w, http.StatusPaymentRequired, APIError{
+		Code:    ErrInsufficientCredits,
+		Message: "insufficient credits",
+		Credits: &CreditInfo{Remaining: 2, Required: 5},
+	})
+
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": {
+		"code": "insufficient_credits",
+		"message": "insufficient credits",
+		"request_id": "req-1",
+		"credits": {"remaining": 2, "required": 5}
+	}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	writeError(context.Background(), w, http.StatusBadRequest, APIError{Code: ErrInvalidBody, Message: "bad"})
+	var body errorEnvelope
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.NotEmpty(t, body.Error.RequestID)
+	assert.Equal(t, body.Error.RequestID, w.Header().Get(requestIDHeader))
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	status, apiErr := upstreamFailure(fmt.Errorf("calling model: %w", context.DeadlineExceeded))
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+	assert.Equal(t, ErrUpstreamTimeout, apiErr.Code)
+
+	status, apiErr = upstreamFailure(errors.New("bad status 500"))
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, ErrUpstream, apiErr.Code)
+}
+
+func TestContinuanceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     map[string]string
+		wantCode ErrorCode
+	}{
+		{name: "missing context", form: map[string]string{}, wantCode: ErrMissingContext},
+		{name: "undecodable context", form: map[string]string{"CONTEXT": "not-a-context"}, wantCode: ErrInvalidContext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewRequestIDMiddleware(http.HandlerFunc(continuance)).ServeHTTP(w, createTestRequest(tt.form))
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var body errorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantCode, body.Error.Code)
+			assert.Equal(t, w.Header().Get(requestIDHeader), body.Error.RequestID)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	geminiEndpoint = "https://generativelanguage.googleapis.com/v1beta/models"
+)
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiGenerationConfig struct {
+	MaxOutputTokens int     `json:"maxOutputTokens"`
+	Temperature     float32 `json:"temperature"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent        `json:"contents"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error,omitempty"`
+}
+
+func textContent(role string, text string) geminiContent {
+	return geminiContent{
+		Role:  role,
+		Parts: []geminiPart{{Text: text}},
+	}
+}
+
+func buildGeminiRequest(p *PromptDeclaration, vars PromptVariables) (*geminiRequest, []byte, error) {
+	reqBody := geminiRequest{
+		Contents: []geminiContent{},
+		GenerationConfig: geminiGenerationConfig{
+			MaxOutputTokens: p.MaxTokens,
+			Temperature:     p.Temperature,
+		},
+	}
+
+	rendered, err := renderPrompt(p, vars)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error rendering prompt: %w", err)
+	}
+
+	if rendered.System != nil {
+		system := textContent("", *rendered.System)
+		reqBody.SystemInstruction = &system
+	}
+	if rendered.InitialUser != nil {
+		reqBody.Contents = append(reqBody.Contents, textContent("user", *rendered.InitialUser))
+	}
+	if rendered.InitialAgent != nil {
+		reqBody.Contents = append(reqBody.Contents, textContent("model", *rendered.InitialAgent))
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	return &reqBody, jsonBody, nil
+}
+
+func buildGeminiContinueRequest(p *PromptDeclaration, vars PromptVariables) (*geminiRequest, []byte, error) {
+	var reqBody geminiRequest
+
+	context, ok := vars["CONTEXT"]
+	if !ok {
+		return nil, nil, fmt.Errorf("no CONTEXT")
+	}
+	text, ok := vars["USER_TEXT"]
+	if !ok {
+		return nil, nil, fmt.Errorf("no USER_TEXT")
+	}
+	err := json.Unmarshal([]byte(context), &reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal context: %v", err)
+	}
+
+	reqBody.Contents = append(reqBody.Contents, textContent("user", text))
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	return &reqBody, jsonBody, nil
+}
+
+func sendToGemini(p *PromptDeclaration, reqBody *geminiRequest, jsonBody []byte) (interface{}, string, *TokenUsage, error) {
+	url := fmt.Sprintf("%s/%s:generateContent", geminiEndpoint, p.Model)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("x-goog-api-key", p.apiKey("GEMINI_API_KEY"))
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return packageGeminiResult(resp, reqBody)
+}
+
+func GeminiProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	reqBody, jsonBody, err := buildGeminiRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToGemini(p, reqBody, jsonBody)
+}
+
+func GeminiContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	reqBody, jsonBody, err := buildGeminiContinueRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToGemini(p, reqBody, jsonBody)
+}
+
+func collectLatestGeminiContents(contents []geminiContent) string {
+	messages := make([]messageParam, 0, len(contents))
+	for _, content := range contents {
+		role := content.Role
+		if role == "model" {
+			role = "assistant"
+		}
+		var text strings.Builder
+		for _, part := range content.Parts {
+			text.WriteString(part.Text)
+		}
+		messages = append(messages, messageParam{Role: role, Content: text.String()})
+	}
+	return collectLatestMessages(messages)
+}
+
+func packageGeminiResult(resp *http.Response, reqBody *geminiRequest) (interface{}, string, *TokenUsage, error) {
+	var gemResponse geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gemResponse); err != nil {
+		return nil, "", nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	if gemResponse.Error != nil {
+		return nil, "", nil, fmt.Errorf("API error: %s", gemResponse.Error.Message)
+	}
+
+	if len(gemResponse.Candidates) == 0 || len(gemResponse.Candidates[0].Content.Parts) == 0 {
+		return nil, "", nil, fmt.Errorf("no content in response")
+	}
+
+	// The API may omit the role on candidates; the stored history needs it
+	reply := gemResponse.Candidates[0].Content
+	reply.Role = "model"
+	reqBody.Contents = append(reqBody.Contents, reply)
+	result := collectLatestGeminiContents(reqBody.Contents)
+
+	var usage *TokenUsage
+	if gemResponse.UsageMetadata != nil {
+		usage = &TokenUsage{InputTokens: gemResponse.UsageMetadata.PromptTokenCount, OutputTokens: gemResponse.UsageMetadata.CandidatesTokenCount}
+	}
+	return *reqBody, result, usage, nil
+}
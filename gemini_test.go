@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildGeminiRequest(t *testing.T) {
+	p := &PromptDeclaration{
+		Model:        "gemini-1.5-flash",
+		MaxTokens:    256,
+		Temperature:  0.2,
+		System:       stringPtr("System {{VAR}}"),
+		InitialUser:  stringPtr("User {{VAR}}"),
+		InitialAgent: stringPtr("Agent {{VAR}}"),
+	}
+
+	req, _, err := buildGeminiRequest(p, PromptVariables{"VAR": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, 256, req.GenerationConfig.MaxOutputTokens)
+	assert.Equal(t, float32(0.2), req.GenerationConfig.Temperature)
+	assert.Equal(t, "System test", req.SystemInstruction.Parts[0].Text)
+	assert.Equal(t, []geminiContent{
+		textContent("user", "User test"),
+		textContent("model", "Agent test"),
+	}, req.Contents)
+}
+
+func TestBuildGeminiContinueRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+		text    string
+		wantErr bool
+	}{
+		{
+			name: "valid continue request",
+			context: `{
+				"contents": [
+					{"role": "user", "parts": [{"text": "Hello"}]},
+					{"role": "model", "parts": [{"text": "Hi"}]}
+				]
+			}`,
+			text: "How are you?",
+		},
+		{
+			name:    "missing context",
+			context: "",
+			text:    "test",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := PromptVariables{
+				"CONTEXT":   tt.context,
+				"USER_TEXT": tt.text,
+			}
+			req, _, err := buildGeminiContinueRequest(&PromptDeclaration{}, vars)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			last := req.Contents[len(req.Contents)-1]
+			assert.Equal(t, "user", last.Role)
+			assert.Equal(t, tt.text, last.Parts[0].Text)
+		})
+	}
+}
+
+func TestPackageGeminiResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		respBody   string
+		wantErr    bool
+		wantResult string
+		wantUsage  *TokenUsage
+	}{
+		{
+			name: "successful response",
+			respBody: `{
+				"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}, {"text": " there!"}]}}],
+				"usageMetadata": {"promptTokenCount": 4, "candidatesTokenCount": 3, "totalTokenCount": 7}
+			}`,
+			wantResult: "Hello there!",
+			wantUsage:  &TokenUsage{InputTokens: 4, OutputTokens: 3},
+		},
+		{
+			name: "response without usage",
+			respBody: `{
+				"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}, {"text": " there!"}]}}]
+			}`,
+			wantResult: "Hello there!",
+		},
+		{
+			name: "error response",
+			respBody: `{
+				"error": {"code": 400, "message": "Invalid request", "status": "INVALID_ARGUMENT"}
+			}`,
+			wantErr: true,
+		},
+		{
+			name:     "no candidates",
+			respBody: `{"candidates": []}`,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Body: io.NopCloser(strings.NewReader(tt.respBody)),
+			}
+			reqBody := &geminiRequest{
+				Contents: []geminiContent{textContent("user", "Hi")},
+			}
+
+			_, result, usage, err := packageGeminiResult(resp, reqBody)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantResult, result)
+			assert.Equal(t, tt.wantUsage, usage)
+		})
+	}
+}
+
+func TestGeminiProcessAndContinue(t *testing.T) {
+	var received geminiRequest
+	var receivedPath string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-key", r.Header.Get("x-goog-api-key"))
+		receivedPath = r.URL.Path
+		received = geminiRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "reply"}]}}]}`))
+	}))
+	defer mockServer.Close()
+
+	originalEndpoint := geminiEndpoint
+	geminiEndpoint = mockServer.URL
+	defer func() { geminiEndpoint = originalEndpoint }()
+	t.Setenv("GEMINI_API_KEY", "test-key")
+
+	p := &PromptDeclaration{
+		Service:     Gemini,
+		Model:       "gemini-1.5-flash",
+		MaxTokens:   100,
+		Temperature: 0.4,
+		System:      stringPtr("Be brief"),
+		InitialUser: stringPtr("Hello {{NAME}}"),
+	}
+
+	modelContext, result, _, err := GeminiProcessPrompt(p, PromptVariables{"NAME": "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", result)
+	assert.Equal(t, "/gemini-1.5-flash:generateContent", receivedPath)
+	assert.Equal(t, "Be brief", received.SystemInstruction.Parts[0].Text)
+	assert.Equal(t, "Hello bob", received.Contents[0].Parts[0].Text)
+	assert.Equal(t, 100, received.GenerationConfig.MaxOutputTokens)
+
+	contextJson, err := json.Marshal(modelContext)
+	assert.NoError(t, err)
+
+	vars := PromptVariables{
+		"CONTEXT":   string(contextJson),
+		"USER_TEXT": "And again",
+	}
+	_, result, _, err = GeminiContinuePrompt(p, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", result)
+	assert.Equal(t, "Be brief", received.SystemInstruction.Parts[0].Text)
+	assert.Equal(t, 3, len(received.Contents))
+	assert.Equal(t, "model", received.Contents[1].Role)
+	assert.Equal(t, "And again", received.Contents[2].Parts[0].Text)
+}
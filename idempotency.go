@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader         = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	defaultIdempotencyTTL     = 24 * time.Hour
+	maxIdempotencyKeyLength   = 255
+	maxIdempotencyEntries     = 10000
+	// maxMultipartMemory matches what FormValue uses for multipart bodies
+	maxMultipartMemory = 32 << 20
+)
+
+// IdempotencyKey carries the outcome a handler marks once its prompt has
+// run and the result is worth replaying.
+var IdempotencyKey = contextKey("idempotency")
+
+type idempotentOutcome struct {
+	completed bool
+}
+
+// idempotentResponse is a finished request. done closes once the first
+// request with the key is over; a response only stays if it completed.
+// fingerprint identifies the request the response belongs to.
+type idempotentResponse struct {
+	done        chan struct{}
+	fingerprint [sha256.Size]byte
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyCache remembers responses by user, route and Idempotency-Key
+// so a client retry neither charges nor calls the model twice.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+var idempotentResponses *idempotencyCache
+
+func init() {
+	ttl, err := durationEnv("IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	if err != nil {
+		panic(err.Error())
+	}
+	if ttl > 0 {
+		idempotentResponses = newIdempotencyCache(ttl)
+	}
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*idempotentResponse),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// begin returns the entry for key and whether the caller is the first with
+// it and must run the request and then finish it.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if entry, ok := c.entries[key]; ok {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			return entry, false
+		}
+		delete(c.entries, key)
+	}
+	if len(c.entries) >= maxIdempotencyEntries {
+		c.evict(now)
+	}
+	entry := &idempotentResponse{done: make(chan struct{}), fingerprint: fingerprint}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// finish keeps a completed response for the TTL, or forgets the key so a
+// failed request can be retried, and wakes anyone waiting on it.
+func (c *idempotencyCache) finish(key string, entry *idempotentResponse, rec *responseRecorder, completed bool) {
+	c.mu.Lock()
+	if completed {
+		entry.status = rec.status
+		entry.header = rec.Header().Clone()
+		entry.body = rec.body.Bytes()
+		entry.expires = c.now().Add(c.ttl)
+	} else {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// evict drops expired responses, and if that frees nothing, arbitrary
+// finished ones. Requests still in flight are never dropped.
+func (c *idempotencyCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key, entry := range c.entries {
+		if len(c.entries) < maxIdempotencyEntries {
+			return
+		}
+		if !entry.expires.IsZero() {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// markIdempotentCompleted tells the idempotency middleware the response
+// being written is a delivered result that a retry should get back.
+func markIdempotentCompleted(ctx context.Context) {
+	if outcome, ok := ctx.Value(IdempotencyKey).(*idempotentOutcome); ok {
+		outcome.completed = true
+	}
+}
+
+// requestFingerprint hashes a request's parsed form, which holds its
+// variables, or CONTEXT, CONVERSATION_ID and USER_TEXT for a continuation,
+// along with whether it asked for a stream. A multipart body is parsed here
+// too, since once r.Form is set FormValue no longer reads it.
+func requestFingerprint(r *http.Request) ([sha256.Size]byte, error) {
+	if err := parseRequestBody(r); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256([]byte(fmt.Sprintf("%t\x00%s", wantsStream(r), r.Form.Encode()))), nil
+}
+
+func replayResponse(w http.ResponseWriter, entry *idempotentResponse) {
+	for name, values := range entry.header {
+		// the retry keeps its own request ID
+		if name == http.CanonicalHeaderKey(requestIDHeader) {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(entry.status)
+	if _, err := w.Write(entry.body); err != nil {
+		fmt.Printf("failed to write replayed response: %v\n", err)
+	}
+}
+
+// idempotent wraps an authenticated handler so that requests repeating an
+// Idempotency-Key get the first request's response. A duplicate arriving
+// while the first is still running waits for it. A key reused with a
+// different request is refused rather than answered for the first one.
+func idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || idempotentResponses == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidParameter, Message: fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), Field: idempotencyHeader})
+			return
+		}
+		fingerprint, err := requestFingerprint(r)
+		if err != nil {
+			fmt.Printf("Bad request body %v\n", err)
+			writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidBody, Message: err.Error()})
+			return
+		}
+		user := r.Context().Value(AuthenticatedUserKey).(string)
+		cacheKey := user + "\x00" + r.URL.Path + "\x00" + key
+
+		for {
+			entry, first := idempotentResponses.begin(cacheKey, fingerprint)
+			if entry.fingerprint != fingerprint {
+				writeError(r.Context(), w, http.StatusUnprocessableEntity, APIError{Code: ErrInvalidParameter, Message: "Idempotency-Key was already used for a different request", Field: idempotencyHeader})
+				return
+			}
+			if first {
+				outcome := &idempotentOutcome{}
+				rec := &responseRecorder{ResponseWriter: w}
+				func() {
+					// a panicking handler must not leave waiters blocked
+					defer func() { idempotentResponses.finish(cacheKey, entry, rec, outcome.completed) }()
+					next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), IdempotencyKey, outcome)))
+				}()
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.expires.IsZero() {
+				// the first attempt failed and was forgotten, so try again
+				continue
+			}
+			replayResponse(w, entry)
+			return
+		}
+	})
+}
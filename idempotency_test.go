@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func useIdempotencyCache(t *testing.T) *idempotencyCache {
+	t.Helper()
+	saved := idempotentResponses
+	idempotentResponses = newIdempotencyCache(time.Hour)
+	t.Cleanup(func() { idempotentResponses = saved })
+	return idempotentResponses
+}
+
+func idempotentRequest(user, key string) *http.Request {
+	req := createTestRequest(map[string]string{"NAME": "bob"})
+	req.URL.Path = "/v1/prompt/fake"
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	return req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, user))
+}
+
+func TestIdempotentPrompt(t *testing.T) {
+	useIdempotencyCache(t)
+	ledger := useTestLedger(t)
+	ctx := context.Background()
+	ledger.AddCredits(ctx, "test/path", "alice", 10)
+	ledger.AddCredits(ctx, "test/path", "bob", 10)
+
+	const fakeService = ServiceType("fake")
+	fake := &fakeProvider{}
+	RegisterProvider(fakeService, fake)
+	defer delete(providers, fakeService)
+
+	p := PromptDeclaration{
+		Service:     fakeService,
+		MaxTokens:   10,
+		InitialUser: stringPtr("Hi {{NAME}}"),
+		Cost:        fcs.ChargeData{Path: "test/path", Cost: 2},
+		Variables:   []VariableDeclaration{{Name: "NAME"}},
+	}
+	handler := idempotent(constructPromptHandler("fake", &p))
+
+	tests := []struct {
+		name          string
+		user          string
+		key           string
+		wantReplayed  bool
+		wantProcessed int
+		wantBalance   int
+	}{
+		{name: "first", user: "alice", key: "k1", wantProcessed: 1, wantBalance: 8},
+		{name: "retry", user: "alice", key: "k1", wantReplayed: true, wantProcessed: 1, wantBalance: 8},
+		{name: "new key", user: "alice", key: "k2", wantProcessed: 2, wantBalance: 6},
+		{name: "other user same key", user: "bob", key: "k1", wantProcessed: 3, wantBalance: 8},
+		{name: "no key", user: "alice", wantProcessed: 4, wantBalance: 4},
+	}
+
+	var first string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			w.Header().Set(requestIDHeader, tt.name)
+			handler.ServeHTTP(w, idempotentRequest(tt.user, tt.key))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.name, w.Header().Get(requestIDHeader))
+			assert.Equal(t, tt.wantReplayed, w.Header().Get(idempotencyReplayedHeader) == "true")
+			assert.Equal(t, tt.wantProcessed, fake.processed)
+			balance, _ := ledger.Balance(ctx, "test/path", tt.user)
+			assert.Equal(t, tt.wantBalance, balance)
+
+			var resp Response
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.NotEmpty(t, resp.Context)
+			if tt.name == "first" {
+				first = w.Body.String()
+			}
+			if tt.wantReplayed {
+				assert.Equal(t, first, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestIdempotentFailureNotKept(t *testing.T) {
+	useIdempotencyCache(t)
+	calls := 0
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			writeError(r.Context(), w, http.StatusBadGateway, APIError{Code: ErrUpstream, Message: "upstream failed"})
+			return
+		}
+		markIdempotentCompleted(r.Context())
+		w.Write([]byte("ok"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, idempotentRequest("alice", "k"))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, idempotentRequest("alice", "k"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotentConcurrentDuplicates(t *testing.T) {
+	useIdempotencyCache(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(started)
+		<-release
+		markIdempotentCompleted(r.Context())
+		w.Write([]byte("result"))
+	}))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(first, idempotentRequest("alice", "k"))
+		close(done)
+	}()
+	<-started
+
+	second := httptest.NewRecorder()
+	waited := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(second, idempotentRequest("alice", "k"))
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("duplicate did not wait for the request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	<-waited
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "result", first.Body.String())
+	assert.Equal(t, "result", second.Body.String())
+	assert.Equal(t, "true", second.Header().Get(idempotencyReplayedHeader))
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	cache := useIdempotencyCache(t)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+	calls := 0
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		markIdempotentCompleted(r.Context())
+		w.Write([]byte("ok"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("alice", "k"))
+	now = now.Add(30 * time.Minute)
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("alice", "k"))
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Hour)
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("alice", "k"))
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	useIdempotencyCache(t)
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran with an invalid key")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, idempotentRequest("alice", strings.Repeat("k", maxIdempotencyKeyLength+1)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), string(ErrInvalidParameter))
+}
+
+func TestIdempotencyKeyReusedForDifferentRequest(t *testing.T) {
+	useIdempotencyCache(t)
+	calls := 0
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if err := parseRequestBody(r); err != nil {
+			t.Errorf("parseRequestBody() error = %v", err)
+		}
+		markIdempotentCompleted(r.Context())
+		w.Write([]byte("continued " + r.FormValue("CONTEXT")))
+	}))
+	continueRequest := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v1/continue", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, "k")
+		return req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "alice"))
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, continueRequest(`{"CONTEXT": "first", "USER_TEXT": "hi"}`))
+	assert.Equal(t, "continued first", w.Body.String())
+
+	for _, body := range []string{
+		`{"CONTEXT": "second", "USER_TEXT": "hi"}`,
+		`{"CONTEXT": "first", "USER_TEXT": "bye"}`,
+	} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, continueRequest(body))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, body)
+		assert.Contains(t, w.Body.String(), string(ErrInvalidParameter))
+		assert.NotContains(t, w.Body.String(), "continued first")
+	}
+
+	// asking for a stream is a different request from asking for JSON
+	req := continueRequest(`{"CONTEXT": "first", "USER_TEXT": "hi"}`)
+	req.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// the same request, however its fields are ordered, still replays
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, continueRequest(`{"USER_TEXT": "hi", "CONTEXT": "first"}`))
+	assert.Equal(t, "continued first", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, 1, calls)
+
+	// a multipart body is part of the request too, and still reaches the handler
+	multipartRequest := func(context string) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("CONTEXT", context)
+		mw.WriteField("USER_TEXT", "hi")
+		mw.Close()
+		req := continueRequest("")
+		req.Body = io.NopCloser(&body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set(idempotencyHeader, "multipart")
+		return req
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, multipartRequest("alice"))
+	assert.Equal(t, "continued alice", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, multipartRequest("bob"))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, 2, calls)
+}
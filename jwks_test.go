@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	b64 "encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	enc := b64.RawURLEncoding.EncodeToString
+	coord := func(n *big.Int) string {
+		return enc(n.FillBytes(make([]byte, 32)))
+	}
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"alg": "RS256",
+				"n":   enc(rsaKey.N.Bytes()),
+				"e":   enc(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"alg": "ES256",
+				"crv": "P-256",
+				"x":   coord(ecKey.X),
+				"y":   coord(ecKey.Y),
+			},
+		},
+	}
+	data, err := json.Marshal(set)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestValidateLocalToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	keys, err := loadJWKS("", writeTestJWKS(t, rsaKey, ecKey), 0)
+	assert.NoError(t, err)
+	jwks, tokenIssuer, tokenAudience = keys, "https://issuer.example", "prompt-service"
+	defer func() { jwks, tokenIssuer, tokenAudience = nil, "", "" }()
+
+	now := time.Now()
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"user_id": "qbert",
+			"iss":     "https://issuer.example",
+			"aud":     "prompt-service",
+			"exp":     now.Add(time.Hour).Unix(),
+			"nbf":     now.Add(-time.Minute).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "rs256", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil))},
+		{name: "es256", token: signTestToken(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil))},
+		{name: "audience list", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"aud": []string{"other", "prompt-service"}}))},
+		{name: "expired", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})), wantErr: true},
+		{name: "missing exp", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": nil})), wantErr: true},
+		{name: "not yet valid", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})), wantErr: true},
+		{name: "wrong issuer", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.example"})), wantErr: true},
+		{name: "wrong audience", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"aud": "other"})), wantErr: true},
+		{name: "wrong key", token: signTestToken(t, jwt.SigningMethodRS256, "rsa", otherKey, claims(nil)), wantErr: true},
+		{name: "unknown kid", token: signTestToken(t, jwt.SigningMethodRS256, "missing", rsaKey, claims(nil)), wantErr: true},
+		{name: "hmac rejected", token: signTestToken(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims(nil)), wantErr: true},
+		{name: "garbage", token: "not.a.token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateLocalToken(tt.token)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "qbert", got["user_id"])
+		})
+	}
+}
+
+func TestValidateTokenDispatchesToJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keys, err := loadJWKS("", writeTestJWKS(t, rsaKey, ecKey), 0)
+	assert.NoError(t, err)
+
+	jwks, tokenValidationMode = keys, JWKSValidation
+	defer func() { jwks, tokenValidationMode = nil, RemoteValidation }()
+
+	token := signTestToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{
+		"user_id": "qbert",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+	claims, err := validateToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "qbert", claims["user_id"])
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	fb "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/db"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+// Credit ledger backends selected with CREDIT_LEDGER.
+const (
+	FirebaseLedger = "firebase"
+	SQLiteLedger   = "sqlite"
+	MemoryLedger   = "memory"
+)
+
+// Kinds of credit transaction.
+const (
+	CreditGrant  = "grant"
+	CreditCharge = "charge"
+	CreditRefund = "refund"
+	CreditUnpaid = "unpaid" // a settled cost over the hold that could not be collected
+)
+
+// creditHistoryPath is where the Firebase ledger keeps transactions.
+const creditHistoryPath = "credit_history"
+
+var errInvalidCursor = errors.New("invalid history cursor")
+
+// CreditTransaction is one entry in a user's credit history. Amount is
+// always positive; Kind says which way it moved.
+type CreditTransaction struct {
+	ID        string    `json:"id,omitempty"`
+	Kind      string    `json:"kind"`
+	Path      string    `json:"path"`
+	Amount    int       `json:"amount"`
+	Prompt    string    `json:"prompt,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CreditLedger holds credit balances, one account per charge path and user,
+// and the history of what moved them.
+type CreditLedger interface {
+	AccountExists(ctx context.Context, path, user string) (bool, error)
+	// Balance returns the balance, or zero if there is no account. Unlike
+	// AddCredits it does not create one.
+	Balance(ctx context.Context, path, user string) (int, error)
+	// AddCredits adds amount, which may be negative, and returns the new
+	// balance. Adding zero reads it.
+	AddCredits(ctx context.Context, path, user string, amount int) (int, error)
+	// SubtractCredits takes amount only if the balance covers it, reporting
+	// whether it did and the balance left.
+	SubtractCredits(ctx context.Context, path, user string, amount int) (bool, int, error)
+	// RefundCredits gives back amount taken by SubtractCredits.
+	RefundCredits(ctx context.Context, path, user string, amount int) error
+	// Record appends tx to user's history; its ID is assigned.
+	Record(ctx context.Context, user string, tx CreditTransaction) error
+	// History returns up to limit of user's transactions, newest first,
+	// from after cursor, along with the cursor of the next page or "" if
+	// this is the last. An empty cursor starts from the newest.
+	History(ctx context.Context, user string, cursor string, limit int) ([]CreditTransaction, string, error)
+}
+
+var creditLedger CreditLedger
+
+// openCreditLedger opens the ledger named by kind, Firebase by default. The
+// memory ledger is SQLite without a file and is lost on restart.
+func openCreditLedger(kind, path, firebaseURL string) (CreditLedger, error) {
+	switch kind {
+	case "", FirebaseLedger:
+		if firebaseURL == "" {
+			return nil, fmt.Errorf("FIREBASE_DB_URL is not defined")
+		}
+		return &firebaseCreditLedger{url: firebaseURL}, nil
+	case SQLiteLedger:
+		if path == "" {
+			return nil, fmt.Errorf("CREDIT_LEDGER_PATH must be set for the sqlite ledger")
+		}
+		return openSQLiteCreditLedger(path)
+	case MemoryLedger:
+		return openSQLiteCreditLedger(":memory:")
+	}
+	return nil, fmt.Errorf("unknown CREDIT_LEDGER %s", kind)
+}
+
+// firebaseCreditLedger keeps balances in a Firebase realtime database
+// through firebase-credit-service, which charges a fixed cost per service.
+type firebaseCreditLedger struct {
+	url string
+}
+
+func (l *firebaseCreditLedger) service(path string, amount int) *fcs.Service {
+	return fcs.NewService(fcs.ChargeData{Path: path, Cost: amount}, l.url)
+}
+
+func (l *firebaseCreditLedger) AccountExists(ctx context.Context, path, user string) (bool, error) {
+	return l.service(path, 0).AccountExists(ctx, user)
+}
+
+func (l *firebaseCreditLedger) AddCredits(ctx context.Context, path, user string, amount int) (int, error) {
+	return l.service(path, 0).AddCredits(ctx, user, amount)
+}
+
+func (l *firebaseCreditLedger) SubtractCredits(ctx context.Context, path, user string, amount int) (bool, int, error) {
+	return l.service(path, amount).SubtractCredits(ctx, user)
+}
+
+func (l *firebaseCreditLedger) RefundCredits(ctx context.Context, path, user string, amount int) error {
+	return l.service(path, amount).RefundCredits(ctx, user)
+}
+
+func (l *firebaseCreditLedger) Balance(ctx context.Context, path, user string) (int, error) {
+	exists, err := l.AccountExists(ctx, path, user)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return l.AddCredits(ctx, path, user, 0)
+}
+
+func (l *firebaseCreditLedger) historyRef(ctx context.Context, user string) (*db.Ref, error) {
+	app, err := fb.NewApp(ctx, &fb.Config{DatabaseURL: l.url})
+	if err != nil {
+		return nil, fmt.Errorf("new firebase app failed %v", err)
+	}
+	client, err := app.Database(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("new firebase database failed %v", err)
+	}
+	return client.NewRef(creditHistoryPath).Child(user), nil
+}
+
+// Record pushes tx under the user's history, where the push key orders
+// entries by time and serves as the ID.
+func (l *firebaseCreditLedger) Record(ctx context.Context, user string, tx CreditTransaction) error {
+	ref, err := l.historyRef(ctx, user)
+	if err != nil {
+		return err
+	}
+	tx.ID = ""
+	_, err = ref.Push(ctx, tx)
+	return err
+}
+
+func (l *firebaseCreditLedger) History(ctx context.Context, user string, cursor string, limit int) ([]CreditTransaction, string, error) {
+	ref, err := l.historyRef(ctx, user)
+	if err != nil {
+		return nil, "", err
+	}
+	// one extra to tell whether there is another page, and one more for
+	// the cursor itself, which EndAt includes
+	q := ref.OrderByKey()
+	fetch := limit + 1
+	if cursor != "" {
+		q = q.EndAt(cursor)
+		fetch++
+	}
+	nodes, err := q.LimitToLast(fetch).GetOrdered(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Key() > nodes[j].Key() })
+	if cursor != "" && len(nodes) > 0 && nodes[0].Key() == cursor {
+		nodes = nodes[1:]
+	}
+	next := ""
+	if len(nodes) > limit {
+		nodes = nodes[:limit]
+		next = nodes[limit-1].Key()
+	}
+	txs := make([]CreditTransaction, 0, len(nodes))
+	for _, node := range nodes {
+		var tx CreditTransaction
+		if err := node.Unmarshal(&tx); err != nil {
+			return nil, "", err
+		}
+		tx.ID = node.Key()
+		txs = append(txs, tx)
+	}
+	return txs, next, nil
+}
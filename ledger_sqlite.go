@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const creditSchema = `CREATE TABLE IF NOT EXISTS credits (
+	path    TEXT    NOT NULL,
+	user    TEXT    NOT NULL,
+	balance INTEGER NOT NULL,
+	PRIMARY KEY (path, user)
+);
+CREATE TABLE IF NOT EXISTS credit_history (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	user       TEXT    NOT NULL,
+	kind       TEXT    NOT NULL,
+	path       TEXT    NOT NULL,
+	amount     INTEGER NOT NULL,
+	prompt     TEXT    NOT NULL,
+	request_id TEXT    NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS credit_history_user ON credit_history (user, id)`
+
+// sqliteCreditLedger keeps balances in an embedded SQLite database, for
+// local development and single instance deployments.
+type sqliteCreditLedger struct {
+	db *sql.DB
+}
+
+func openSQLiteCreditLedger(path string) (*sqliteCreditLedger, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	// one connection serializes writers, and keeps an in-memory database
+	// from being a different database per connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(creditSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating credit schema: %w", err)
+	}
+	return &sqliteCreditLedger{db: db}, nil
+}
+
+func (l *sqliteCreditLedger) AccountExists(ctx context.Context, path, user string) (bool, error) {
+	var balance int
+	err := l.db.QueryRowContext(ctx, `SELECT balance FROM credits WHERE path = ? AND user = ?`, path, user).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *sqliteCreditLedger) AddCredits(ctx context.Context, path, user string, amount int) (int, error) {
+	var balance int
+	err := l.db.QueryRowContext(ctx, `INSERT INTO credits (path, user, balance) VALUES (?, ?, ?)
+		ON CONFLICT (path, user) DO UPDATE SET balance = balance + excluded.balance
+		RETURNING balance`, path, user, amount).Scan(&balance)
+	if err != nil {
+		return -1, err
+	}
+	return balance, nil
+}
+
+func (l *sqliteCreditLedger) SubtractCredits(ctx context.Context, path, user string, amount int) (bool, int, error) {
+	var balance int
+	err := l.db.QueryRowContext(ctx, `UPDATE credits SET balance = balance - ?
+		WHERE path = ? AND user = ? AND balance >= ?
+		RETURNING balance`, amount, path, user, amount).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, balance, nil
+}
+
+func (l *sqliteCreditLedger) RefundCredits(ctx context.Context, path, user string, amount int) error {
+	_, err := l.AddCredits(ctx, path, user, amount)
+	return err
+}
+
+func (l *sqliteCreditLedger) Balance(ctx context.Context, path, user string) (int, error) {
+	var balance int
+	err := l.db.QueryRowContext(ctx, `SELECT balance FROM credits WHERE path = ? AND user = ?`, path, user).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (l *sqliteCreditLedger) Record(ctx context.Context, user string, tx CreditTransaction) error {
+	_, err := l.db.ExecContext(ctx, `INSERT INTO credit_history (user, kind, path, amount, prompt, request_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, user, tx.Kind, tx.Path, tx.Amount, tx.Prompt, tx.RequestID, tx.Timestamp.UnixNano())
+	return err
+}
+
+// History pages by row ID, which the cursor carries.
+func (l *sqliteCreditLedger) History(ctx context.Context, user string, cursor string, limit int) ([]CreditTransaction, string, error) {
+	before := int64(math.MaxInt64)
+	if cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		before = id
+	}
+	rows, err := l.db.QueryContext(ctx, `SELECT id, kind, path, amount, prompt, request_id, created_at FROM credit_history
+		WHERE user = ? AND id < ? ORDER BY id DESC LIMIT ?`, user, before, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var txs []CreditTransaction
+	for rows.Next() {
+		var id, created int64
+		var tx CreditTransaction
+		if err := rows.Scan(&id, &tx.Kind, &tx.Path, &tx.Amount, &tx.Prompt, &tx.RequestID, &created); err != nil {
+			return nil, "", err
+		}
+		tx.ID = strconv.FormatInt(id, 10)
+		tx.Timestamp = time.Unix(0, created).UTC()
+		txs = append(txs, tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(txs) > limit {
+		txs = txs[:limit]
+		next = txs[limit-1].ID
+	}
+	return txs, next, nil
+}
+
+func (l *sqliteCreditLedger) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenCreditLedger(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind        string
+		path        string
+		firebaseURL string
+		wantErr     bool
+	}{
+		{name: "firebase default", firebaseURL: "https://example.firebaseio.com"},
+		{name: "firebase without url", kind: FirebaseLedger, wantErr: true},
+		{name: "memory", kind: MemoryLedger},
+		{name: "sqlite", kind: SQLiteLedger, path: filepath.Join(t.TempDir(), "credits.db")},
+		{name: "sqlite without path", kind: SQLiteLedger, wantErr: true},
+		{name: "unknown", kind: "redis", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger, err := openCreditLedger(tt.kind, tt.path, tt.firebaseURL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, ledger)
+			if l, ok := ledger.(*sqliteCreditLedger); ok {
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestSQLiteCreditLedger(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "credits.db")
+	ledger, err := openSQLiteCreditLedger(path)
+	assert.NoError(t, err)
+
+	exists, err := ledger.AccountExists(ctx, "app", "alice")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	ok, _, err := ledger.SubtractCredits(ctx, "app", "alice", 1)
+	assert.NoError(t, err)
+	assert.False(t, ok, "charged an account that does not exist")
+
+	balance, err := ledger.AddCredits(ctx, "app", "alice", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, balance)
+
+	ok, balance, err = ledger.SubtractCredits(ctx, "app", "alice", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, balance)
+
+	ok, _, err = ledger.SubtractCredits(ctx, "app", "alice", 3)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, ledger.RefundCredits(ctx, "app", "alice", 3))
+
+	// accounts are per path
+	exists, err = ledger.AccountExists(ctx, "other", "alice")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, ledger.Close())
+
+	reopened, err := openSQLiteCreditLedger(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	balance, err = reopened.AddCredits(ctx, "app", "alice", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, balance)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,8 +14,7 @@ import (
 )
 
 var (
-	prompts     PromptConfig
-	firebaseURL string
+	prompts PromptConfig
 )
 
 func init() {
@@ -33,11 +33,12 @@ func init() {
 		os.Exit(1)
 	}
 
-	firebaseURL = os.Getenv("FIREBASE_DB_URL")
-	if len(firebaseURL) < 1 {
-		fmt.Printf("FIREBASE_DB_URL is not defined")
+	ledger, err := openCreditLedger(os.Getenv("CREDIT_LEDGER"), os.Getenv("CREDIT_LEDGER_PATH"), os.Getenv("FIREBASE_DB_URL"))
+	if err != nil {
+		fmt.Printf("Fatal: credit ledger setup failed: %v\n", err)
 		os.Exit(1)
 	}
+	creditLedger = ledger
 
 	if !ValidatePromptConfig(&prompts) {
 		fmt.Printf("Fatal: PROMPTS environment variable invalid\n")
@@ -46,86 +47,181 @@ func init() {
 }
 
 func constructPromptHandler(name string, p *PromptDeclaration) http.HandlerFunc {
-	creditService := fcs.NewService(p.Cost, firebaseURL)
+	provider, ok := LookupProvider(p.Service)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if p.Service != Anthropic {
-			w.WriteHeader(http.StatusNotImplemented)
+		if !ok {
+			writeError(r.Context(), w, http.StatusNotImplemented, APIError{Code: ErrServiceNotImplemented, Message: fmt.Sprintf("service %s is not available", p.Service)})
+			return
+		}
+		if err := parseRequestBody(r); err != nil {
+			fmt.Printf("Bad request body for %s %v\n", name, err)
+			writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidBody, Message: err.Error()})
+			return
+		}
+		vars, err := CollectVariables(r, p)
+		if err != nil {
+			fmt.Printf("Invalid variables for %s %v\n", name, err)
+			apiErr := APIError{Code: ErrInvalidVariable, Message: err.Error()}
+			var verr *VariableError
+			if errors.As(err, &verr) {
+				apiErr.Field = verr.Field
+				apiErr.Message = verr.Message
+			}
+			writeError(r.Context(), w, http.StatusBadRequest, apiErr)
+			return
+		}
+		addClaimVariables(vars, p, authenticatedClaims(r.Context()))
+		if wantsStream(r) {
+			stream := newEventStream(w)
+			runFunc(r.Context(), &p.Cost, name, p, vars, streamProcessExecutor(provider, stream), stream, w)
 			return
 		}
-		vars := CollectVariables(r, p)
-		executor := AnthropicProcessPrompt
-		runFunc(r.Context(), creditService, name, p, vars, executor, w)
+		runFunc(r.Context(), &p.Cost, name, p, vars, provider.ProcessPrompt, nil, w)
 	}
 }
 
-func runFunc(ctx context.Context, creditService *fcs.Service, name string, p *PromptDeclaration, vars PromptVariables, executor ModelExecutor, w http.ResponseWriter) {
+// runFunc charges the call to charge.Path, or runs it free when charge is
+// nil. A prompt with pricing holds its reservation up front and settles
+// against the tokens the model reports; otherwise charge.Cost is taken.
+func runFunc(ctx context.Context, charge *fcs.ChargeData, name string, p *PromptDeclaration, vars PromptVariables, executor ModelExecutor, stream *eventStream, w http.ResponseWriter) {
 	user := ctx.Value(AuthenticatedUserKey).(string)
-	if creditService != nil && p.Cost.Cost > 0 {
-		exists, err := creditService.AccountExists(ctx, user)
+	fail := func(status int, apiErr APIError) {
+		if stream != nil {
+			stream.Fail(ctx, status, apiErr)
+			return
+		}
+		writeError(ctx, w, status, apiErr)
+	}
+	release, limited := limiter.admit(ctx, name, p, user)
+	if limited != nil {
+		fmt.Printf("rate limited user %s on %s %v\n", user, name, limited)
+		w.Header().Set("Retry-After", limited.retryAfterSeconds())
+		fail(http.StatusTooManyRequests, APIError{Code: ErrRateLimited, Message: limited.Error()})
+		return
+	}
+	defer release()
+	held := 0
+	metered := charge != nil && p.Pricing != nil
+	if metered {
+		held = p.Pricing.Reservation(p, vars)
+	} else if charge != nil {
+		held = charge.Cost
+	}
+	if held > 0 {
+		exists, err := creditLedger.AccountExists(ctx, charge.Path, user)
 		if err != nil {
 			fmt.Printf("account existance check user %s %v\n", user, err)
 		} else if !exists {
-			cred, err := creditService.AddCredits(ctx, user, p.InitialCreditGrant)
+			cred, err := creditLedger.AddCredits(ctx, charge.Path, user, p.InitialCreditGrant)
 			if err != nil {
 				fmt.Printf("Failed to create user %s account %v\n", user, err)
-				w.WriteHeader(http.StatusInternalServerError)
+				fail(http.StatusInternalServerError, APIError{Code: ErrCreditService, Message: "could not create credit account"})
 				return
 			}
 			fmt.Printf("account created for user %s granted %d\n", user, cred)
+			if p.InitialCreditGrant > 0 {
+				recordCredit(ctx, creditLedger, user, CreditGrant, charge.Path, name, p.InitialCreditGrant)
+			}
 		}
-		creditGood, _, err := creditService.SubtractCredits(ctx, user)
+		creditGood, _, err := creditLedger.SubtractCredits(ctx, charge.Path, user, held)
 		if err != nil {
-			fmt.Printf("Failed to charge %d credits to user %s %v\n", p.Cost.Cost, user, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Printf("Failed to charge %d credits to user %s %v\n", held, user, err)
+			fail(http.StatusInternalServerError, APIError{Code: ErrCreditService, Message: "could not charge credits"})
 			return
 		}
 		if !creditGood {
-			fmt.Printf("bad credit charge %d credits to user %s\n", p.Cost.Cost, user)
-			w.WriteHeader(http.StatusPaymentRequired)
+			fmt.Printf("bad credit charge %d credits to user %s\n", held, user)
+			apiErr := APIError{Code: ErrInsufficientCredits, Message: "insufficient credits"}
+			// SubtractCredits only reports the balance on a successful charge
+			if remaining, err := creditLedger.Balance(ctx, charge.Path, user); err == nil {
+				apiErr.Credits = &CreditInfo{Remaining: remaining, Required: held}
+			}
+			fail(http.StatusPaymentRequired, apiErr)
 			return
 		}
+		recordCredit(ctx, creditLedger, user, CreditCharge, charge.Path, name, held)
 	}
-	model_context, response, err := executor(p, vars)
-	if err != nil {
-		if creditService != nil && p.Cost.Cost > 0 {
-			reterr := creditService.RefundCredits(ctx, user)
-			if reterr != nil {
-				fmt.Printf("Failed to return %d credits to user %s %v\n", p.Cost.Cost, user, reterr)
+	// a call that delivers no result gives back everything held for it
+	refundFail := func(status int, apiErr APIError) {
+		if held > 0 {
+			if reterr := creditLedger.RefundCredits(ctx, charge.Path, user, held); reterr != nil {
+				fmt.Printf("Failed to return %d credits to user %s %v\n", held, user, reterr)
+			} else {
+				recordCredit(ctx, creditLedger, user, CreditRefund, charge.Path, name, held)
 			}
 		}
-		fmt.Printf("Failed to process anthropic prompt %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		fail(status, apiErr)
+	}
+	model_context, response, usage, err := executor(p, vars)
+	if errors.Is(err, errClientGone) {
+		// the model ran for a client that left, so the call is still paid for
+		fmt.Printf("client left %s prompt %v\n", name, err)
+		if usage != nil {
+			limiter.recordUsage(ctx, name, p, user, *usage)
+		}
+		if metered && usage != nil {
+			settleCharge(ctx, creditLedger, charge.Path, user, name, held, p.Pricing.Cost(*usage))
+		}
 		return
 	}
-	prompt_context := PromptContext{
-		Prompt:       name,
-		ModelContext: model_context,
+	if err != nil {
+		fmt.Printf("Failed to process %s prompt %v\n", p.Service, err)
+		refundFail(upstreamFailure(err))
+		return
+	}
+	if usage != nil {
+		limiter.recordUsage(ctx, name, p, user, *usage)
+	}
+	prompt_context, err := newPromptContext(ctx, name, p, model_context)
+	if err != nil {
+		fmt.Printf("failed to build context %v\n", err)
+		refundFail(http.StatusInternalServerError, APIError{Code: ErrInternal, Message: "could not package context"})
+		return
 	}
 
 	contextJson, err := json.Marshal(prompt_context)
 	if err != nil {
 		fmt.Printf("failed to marshal context %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		refundFail(http.StatusInternalServerError, APIError{Code: ErrInternal, Message: "could not package context"})
 		return
 	}
 
-	ret, err := MakeResult(contextJson, response)
+	ret, err := MakeResult(user, name, contextJson, response)
 	if err != nil {
 		fmt.Printf("failed to make result %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		refundFail(http.StatusInternalServerError, APIError{Code: ErrInternal, Message: "could not package context"})
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	if conversationStore != nil {
+		if err := storeConversation(ctx, conversationStore, &prompt_context, ret); err != nil {
+			fmt.Printf("failed to store conversation %v\n", err)
+			refundFail(http.StatusInternalServerError, APIError{Code: ErrConversationStore, Message: "could not save conversation"})
+			return
+		}
+	}
+	// without reported usage the reservation stands as the charge
+	if metered && usage != nil {
+		settleCharge(ctx, creditLedger, charge.Path, user, name, held, p.Pricing.Cost(*usage))
+	}
+	// the prompt has run, so a retry gets this result back instead of another run
+	markIdempotentCompleted(ctx)
+	if stream != nil {
+		if err := stream.Send("done", ret); err != nil {
+			fmt.Printf("failed to send final event: %v\n", err)
+		}
+		return
+	}
+
 	jsonResponse, err := json.Marshal(ret)
 	if err != nil {
 		fmt.Printf("failed to marshal response: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		fail(http.StatusInternalServerError, APIError{Code: ErrInternal, Message: "could not encode response"})
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(jsonResponse); err != nil {
 		fmt.Printf("failed to write response: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
@@ -136,9 +232,10 @@ func setupcors() *cors.Cors {
 		origins := strings.Split(originsenv, ",")
 		options := cors.Options{
 			AllowedOrigins:   origins,
-			AllowedMethods:   []string{http.MethodPost},
+			AllowedMethods:   []string{http.MethodGet, http.MethodPost},
 			AllowCredentials: true,
-			AllowedHeaders:   []string{"authorization"},
+			AllowedHeaders:   []string{"authorization", "content-type", "idempotency-key", "x-api-key", "x-request-id"},
+			ExposedHeaders:   []string{"idempotent-replayed", "retry-after", "x-request-id"},
 		}
 		return cors.New(options)
 	} else {
@@ -148,58 +245,128 @@ func setupcors() *cors.Cors {
 }
 
 func continuanceConstructor(name string, p *PromptDeclaration, context string) http.HandlerFunc {
-	var creditService *fcs.Service = nil
-	if p.ContinueCost != nil {
-		creditService = fcs.NewService(*p.ContinueCost, firebaseURL)
+	charge := p.ContinueCost
+	if charge == nil && p.Pricing != nil {
+		// metered prompts always charge for the tokens a turn uses
+		charge = &fcs.ChargeData{Path: p.Cost.Path}
 	}
+	provider, ok := LookupProvider(p.Service)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if p.Service != Anthropic {
-			w.WriteHeader(http.StatusNotImplemented)
+		if !ok {
+			writeError(r.Context(), w, http.StatusNotImplemented, APIError{Code: ErrServiceNotImplemented, Message: fmt.Sprintf("service %s is not available", p.Service)})
 			return
 		}
-		vars := CollectContinuanceVariables(r, context)
-		executor := AnthropicContinuePrompt
-		runFunc(r.Context(), creditService, name, p, vars, executor, w)
+		vars := CollectContinuanceVariables(r)
+		vars["CONTEXT"] = context
+		if wantsStream(r) {
+			stream := newEventStream(w)
+			runFunc(r.Context(), charge, name, p, vars, streamContinueExecutor(provider, stream), stream, w)
+			return
+		}
+		runFunc(r.Context(), charge, name, p, vars, provider.ContinuePrompt, nil, w)
 	}
 }
 
 func continuance(w http.ResponseWriter, r *http.Request) {
+	if err := parseRequestBody(r); err != nil {
+		fmt.Printf("Bad request body %v\n", err)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidBody, Message: err.Error()})
+		return
+	}
 	contextb64 := r.FormValue("CONTEXT")
+	conversationID := r.FormValue("CONVERSATION_ID")
+	if len(contextb64) <= 0 && len(conversationID) > 0 && conversationStore != nil {
+		stored, err := conversationStore.Get(r.Context(), conversationID)
+		if errors.Is(err, errConversationNotFound) {
+			fmt.Printf("no conversation %s\n", conversationID)
+			writeError(r.Context(), w, http.StatusNotFound, APIError{Code: ErrUnknownConversation, Message: "conversation does not exist or has expired", Field: "CONVERSATION_ID"})
+			return
+		}
+		if err != nil {
+			fmt.Printf("failed to load conversation %s %v\n", conversationID, err)
+			writeError(r.Context(), w, http.StatusInternalServerError, APIError{Code: ErrConversationStore, Message: "could not load conversation"})
+			return
+		}
+		contextb64 = stored
+		r = r.WithContext(context.WithValue(r.Context(), ConversationIDKey, conversationID))
+	}
 	if len(contextb64) <= 0 {
 		fmt.Printf("CONTEXT not set\n")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrMissingContext, Message: "CONTEXT or CONVERSATION_ID is required", Field: "CONTEXT"})
 		return
 	}
-	promptname, context, err := UnpackContext(contextb64)
-
+	promptname, err := PeekContextPrompt(contextb64)
 	if err != nil {
 		fmt.Printf("Error decoding CONTEXT %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidContext, Message: "CONTEXT could not be decoded", Field: "CONTEXT"})
 		return
 	}
 
 	prompt, pok := prompts[promptname]
 	if !pok {
 		fmt.Printf("no prompt %s exists\n", promptname)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrUnknownPrompt, Message: fmt.Sprintf("prompt %s does not exist", promptname)})
 		return
 	}
 
-	execution := continuanceConstructor(promptname, &prompt, context)
-	NewTokenMiddleware(execution, prompt.RequiredScope).ServeHTTP(w, r)
+	NewScopedTokenMiddleware(idempotent(boundContinuance(contextb64, &prompt)), prompt.scopeRequirement()).ServeHTTP(w, r)
+}
+
+// boundContinuance opens the context for the authenticated user, so a
+// context replayed by anyone but the user it was issued to is refused.
+func boundContinuance(contextb64 string, p *PromptDeclaration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(AuthenticatedUserKey).(string)
+		pc, err := UnpackContext(contextb64, user)
+		if errors.Is(err, errContextNotBound) {
+			fmt.Printf("CONTEXT not issued to user %s\n", user)
+			writeError(r.Context(), w, http.StatusForbidden, APIError{Code: ErrContextForbidden, Message: "CONTEXT was not issued to this user", Field: "CONTEXT"})
+			return
+		}
+		if errors.Is(err, errContextExpired) {
+			fmt.Printf("CONTEXT expired for user %s\n", user)
+			writeError(r.Context(), w, http.StatusGone, APIError{Code: ErrContextExpired, Message: "CONTEXT has expired, start a new conversation", Field: "CONTEXT"})
+			return
+		}
+		if errors.Is(err, errContextKeyRetired) {
+			fmt.Printf("CONTEXT key retired for user %s %v\n", user, err)
+			writeError(r.Context(), w, http.StatusGone, APIError{Code: ErrContextKeyRetired, Message: "CONTEXT was sealed with a retired key, start a new conversation", Field: "CONTEXT"})
+			return
+		}
+		if errors.Is(err, errContextOutdated) {
+			fmt.Printf("unversioned CONTEXT refused for user %s\n", user)
+			writeError(r.Context(), w, http.StatusGone, APIError{Code: ErrContextOutdated, Message: "CONTEXT predates this service version, start a new conversation", Field: "CONTEXT"})
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error decoding CONTEXT %v\n", err)
+			writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidContext, Message: "CONTEXT could not be decoded", Field: "CONTEXT"})
+			return
+		}
+		// a prompt moved to another service cannot read the old one's history
+		if !pc.readableBy(p.Service) {
+			fmt.Printf("CONTEXT from %s cannot continue on %s\n", pc.Provider, p.Service)
+			writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidContext, Message: "CONTEXT was created by a different model service", Field: "CONTEXT"})
+			return
+		}
+		ctx := context.WithValue(r.Context(), ContextIssuedAtKey, pc.issuedAt())
+		continuanceConstructor(pc.Prompt, p, string(pc.ModelContext)).ServeHTTP(w, r.WithContext(ctx))
+	}
 }
 
 func main() {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/v1/continue", continuance)
+	mux.Handle("GET /v1/credits", NewScopedTokenMiddleware(http.HandlerFunc(creditBalances), creditsScope))
+	mux.Handle("GET /v1/credits/history", NewScopedTokenMiddleware(http.HandlerFunc(creditHistory), creditsScope))
 	for k, v := range prompts {
 		path := fmt.Sprintf("/v1/prompt/%s", k)
-		mux.HandleFunc(path, NewTokenMiddleware(constructPromptHandler(k, &v), v.RequiredScope).ServeHTTP)
+		mux.HandleFunc(path, NewScopedTokenMiddleware(idempotent(constructPromptHandler(k, &v)), v.scopeRequirement()).ServeHTTP)
 	}
 
 	corsobj := setupcors()
-	handler := corsobj.Handler(mux)
+	handler := corsobj.Handler(NewRequestIDMiddleware(mux))
 
 	if err := http.ListenAndServe("0.0.0.0:8080", handler); err != nil {
 		fmt.Printf("Server error: %v\n", err)
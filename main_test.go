@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+
+	fcs "github.com/tmiv/firebase-credit-service"
 )
 
 func TestMain(m *testing.M) {
@@ -79,18 +86,200 @@ func TestSetupCors(t *testing.T) {
 }
 
 func TestConstructPromptHandler(t *testing.T) {
-	// Create a test prompt declaration
-	testPrompt := PromptDeclaration{
-		Service:   Anthropic,
-		Model:     "claude-3",
-		MaxTokens: 1000,
+	const fakeService = ServiceType("fake")
+
+	tests := []struct {
+		name          string
+		service       ServiceType
+		balance       int
+		form          map[string]string
+		wantStatus    int
+		wantResult    string
+		wantBalance   int
+		wantProcessed int
+	}{
+		{name: "charged and run", service: fakeService, balance: 10, form: map[string]string{"NAME": "bob"}, wantStatus: http.StatusOK, wantResult: "processed bob", wantBalance: 7, wantProcessed: 1},
+		{name: "insufficient credits", service: fakeService, balance: 2, form: map[string]string{"NAME": "bob"}, wantStatus: http.StatusPaymentRequired, wantBalance: 2},
+		{name: "missing variable", service: fakeService, balance: 10, form: map[string]string{}, wantStatus: http.StatusBadRequest, wantBalance: 10},
+		{name: "unavailable service", service: "unregistered", balance: 10, form: map[string]string{"NAME": "bob"}, wantStatus: http.StatusNotImplemented, wantBalance: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := useTestLedger(t)
+			ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+			if _, err := ledger.AddCredits(ctx, "test/path", "alice", tt.balance); err != nil {
+				t.Fatalf("AddCredits() error = %v", err)
+			}
+			fake := &fakeProvider{}
+			RegisterProvider(fakeService, fake)
+			defer delete(providers, fakeService)
+
+			p := PromptDeclaration{
+				Service:     tt.service,
+				MaxTokens:   1000,
+				InitialUser: stringPtr("Hi {{NAME}}"),
+				Cost:        fcs.ChargeData{Path: "test/path", Cost: 3},
+				Variables:   []VariableDeclaration{{Name: "NAME", Required: true}},
+			}
+			req := createTestRequest(tt.form).WithContext(ctx)
+			w := httptest.NewRecorder()
+			constructPromptHandler("fake", &p).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantResult != "" {
+				var resp Response
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Result != tt.wantResult {
+					t.Errorf("response = %+v, %v, want result %q", resp, err, tt.wantResult)
+				}
+			}
+			if fake.processed != tt.wantProcessed {
+				t.Errorf("processed = %d, want %d", fake.processed, tt.wantProcessed)
+			}
+			balance, err := ledger.Balance(ctx, "test/path", "alice")
+			if err != nil || balance != tt.wantBalance {
+				t.Errorf("balance = %d, %v, want %d", balance, err, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestContinuanceBoundToUser(t *testing.T) {
+	const fakeService = ServiceType("fake")
+	RegisterProvider(fakeService, &fakeProvider{})
+	defer delete(providers, fakeService)
+
+	saved := prompts
+	prompts = PromptConfig{"fake": {
+		Service:       fakeService,
+		Cost:          fcs.ChargeData{Path: "test/path"},
+		RequiredScope: "hello",
+	}}
+	defer func() { prompts = saved }()
+
+	apiKeys = map[string]APIKey{
+		hashAPIKey("alice-key"): {ID: "alice", Scopes: []string{"hello"}},
+		hashAPIKey("bob-key"):   {ID: "bob", Scopes: []string{"hello"}},
+	}
+	defer func() { apiKeys = nil }()
+
+	contextJson, _ := json.Marshal(PromptContext{Version: currentContextVersion, Provider: fakeService, Prompt: "fake", ModelContext: json.RawMessage(`{"history":"start"}`)})
+	issued, err := MakeResult(apiKeyPrincipalPrefix+"alice", "fake", contextJson, "hi")
+	if err != nil {
+		t.Fatalf("MakeResult() error = %v", err)
+	}
+
+	otherJson, _ := json.Marshal(PromptContext{Version: currentContextVersion, Provider: Gemini, Prompt: "fake", ModelContext: json.RawMessage(`{}`)})
+	otherProvider, err := MakeResult(apiKeyPrincipalPrefix+"alice", "fake", otherJson, "hi")
+	if err != nil {
+		t.Fatalf("MakeResult() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		context    string
+		key        string
+		wantStatus int
+	}{
+		{name: "issuing user", context: issued.Context, key: "alice-key", wantStatus: http.StatusOK},
+		{name: "other user", context: issued.Context, key: "bob-key", wantStatus: http.StatusForbidden},
+		{name: "other provider", context: otherProvider.Context, key: "alice-key", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(map[string]string{"CONTEXT": tt.context, "USER_TEXT": "again"})
+			req.Header.Set(apiKeyHeader, tt.key)
+			w := httptest.NewRecorder()
+			continuance(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("continuance() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRunFuncCredits(t *testing.T) {
+	const path = "test/credits"
+	metered := &TokenPricing{InputPer1K: 1000, OutputPer1K: 1000, Reserve: 10}
+
+	tests := []struct {
+		name          string
+		balance       *int
+		cost          int
+		grant         int
+		pricing       *TokenPricing
+		free          bool
+		usage         *TokenUsage
+		execErr       error
+		wantStatus    int
+		wantBalance   int
+		wantNoAccount bool
+	}{
+		{name: "flat cost", balance: intPtr(10), cost: 3, wantStatus: http.StatusOK, wantBalance: 7},
+		{name: "new account granted", grant: 5, cost: 2, wantStatus: http.StatusOK, wantBalance: 3},
+		{name: "insufficient credits", balance: intPtr(1), cost: 3, wantStatus: http.StatusPaymentRequired, wantBalance: 1},
+		{name: "upstream failure refunds", balance: intPtr(10), cost: 3, execErr: errors.New("boom"), wantStatus: http.StatusBadGateway, wantBalance: 10},
+		{name: "metered refunds unused", balance: intPtr(20), pricing: metered, usage: &TokenUsage{InputTokens: 2, OutputTokens: 3}, wantStatus: http.StatusOK, wantBalance: 15},
+		{name: "metered collects overage", balance: intPtr(20), pricing: metered, usage: &TokenUsage{InputTokens: 10, OutputTokens: 5}, wantStatus: http.StatusOK, wantBalance: 5},
+		{name: "metered without usage", balance: intPtr(20), pricing: metered, wantStatus: http.StatusOK, wantBalance: 10},
+		{name: "metered insufficient for reservation", balance: intPtr(9), pricing: metered, usage: &TokenUsage{InputTokens: 1}, wantStatus: http.StatusPaymentRequired, wantBalance: 9},
+		{name: "free", free: true, cost: 3, wantStatus: http.StatusOK, wantNoAccount: true},
 	}
 
-	// Create the handler
-	handler := constructPromptHandler("testPrompt", &testPrompt)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := useTestLedger(t)
+			ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+			if tt.balance != nil {
+				if _, err := ledger.AddCredits(ctx, path, "alice", *tt.balance); err != nil {
+					t.Fatalf("AddCredits() error = %v", err)
+				}
+			}
+
+			p := &PromptDeclaration{
+				Service:            Anthropic,
+				MaxTokens:          5,
+				Cost:               fcs.ChargeData{Path: path, Cost: tt.cost},
+				Pricing:            tt.pricing,
+				InitialCreditGrant: tt.grant,
+			}
+			charge := &p.Cost
+			if tt.free {
+				charge = nil
+			}
+			executor := func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+				if tt.execErr != nil {
+					return nil, "", nil, tt.execErr
+				}
+				return map[string]string{"history": "start"}, "done", tt.usage, nil
+			}
 
-	// TODO: Add more specific tests for the handler functionality
-	if handler == nil {
-		t.Error("constructPromptHandler() returned nil")
+			w := httptest.NewRecorder()
+			runFunc(ctx, charge, "test", p, PromptVariables{}, executor, nil, w)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("runFunc() status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			exists, err := ledger.AccountExists(ctx, path, "alice")
+			if err != nil {
+				t.Fatalf("AccountExists() error = %v", err)
+			}
+			if tt.wantNoAccount {
+				if exists {
+					t.Error("free call created a credit account")
+				}
+				return
+			}
+			balance, err := ledger.AddCredits(ctx, path, "alice", 0)
+			if err != nil {
+				t.Fatalf("AddCredits() error = %v", err)
+			}
+			if balance != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", balance, tt.wantBalance)
+			}
+		})
 	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// TokenUsage is what one model call consumed.
+type TokenUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// TokenPricing charges a prompt by the tokens it uses instead of its flat
+// cost. Rates are credits per 1000 tokens.
+type TokenPricing struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+	Minimum     int     `json:"minimum,omitempty"` // least a call is charged
+	Reserve     int     `json:"reserve,omitempty"` // credits held before the call; estimated when zero
+}
+
+// MaxOutputCost is what a reply of max tokens costs, which a reserve must
+// cover.
+func (tp *TokenPricing) MaxOutputCost(maxTokens int) int {
+	return tp.Cost(TokenUsage{OutputTokens: maxTokens})
+}
+
+func (tp *TokenPricing) Validate() error {
+	if tp.InputPer1K < 0 || tp.OutputPer1K < 0 || tp.Minimum < 0 || tp.Reserve < 0 {
+		return fmt.Errorf("pricing must not be negative")
+	}
+	if tp.InputPer1K == 0 && tp.OutputPer1K == 0 && tp.Minimum == 0 {
+		return fmt.Errorf("pricing needs a rate or a minimum")
+	}
+	if tp.Reserve > 0 && tp.Reserve < tp.Minimum {
+		return fmt.Errorf("reserve is below the minimum charge")
+	}
+	return nil
+}
+
+// Cost is the whole number of credits a call with the given usage costs,
+// rounded up and never below the minimum.
+func (tp *TokenPricing) Cost(usage TokenUsage) int {
+	cost := int(math.Ceil(float64(usage.InputTokens)*tp.InputPer1K/1000 + float64(usage.OutputTokens)*tp.OutputPer1K/1000))
+	if cost < tp.Minimum {
+		return tp.Minimum
+	}
+	return cost
+}
+
+// estimateInputTokens overestimates the prompt size from its text, counting
+// a token for every three bytes where English averages about four.
+func estimateInputTokens(p *PromptDeclaration, vars PromptVariables) int {
+	size := 0
+	for _, text := range []*string{p.System, p.InitialUser, p.InitialAgent} {
+		if text != nil {
+			size += len(*text)
+		}
+	}
+	for _, v := range vars {
+		size += len(v)
+	}
+	return size/3 + 1
+}
+
+// Reservation is the most a call may cost: the configured reserve, or the
+// estimated input plus the full max_tokens of output.
+func (tp *TokenPricing) Reservation(p *PromptDeclaration, vars PromptVariables) int {
+	if tp.Reserve > 0 {
+		return tp.Reserve
+	}
+	return tp.Cost(TokenUsage{InputTokens: estimateInputTokens(p, vars), OutputTokens: p.MaxTokens})
+}
+
+// settleCharge reconciles a reservation with what the call actually cost,
+// returning unused credits or collecting the shortfall. A shortfall the user
+// cannot pay is recorded as unpaid so it shows in their history.
+func settleCharge(ctx context.Context, ledger CreditLedger, path, user, prompt string, held, actual int) {
+	switch {
+	case actual < held:
+		if err := ledger.RefundCredits(ctx, path, user, held-actual); err != nil {
+			fmt.Printf("Failed to return %d unused credits to user %s %v\n", held-actual, user, err)
+			return
+		}
+		recordCredit(ctx, ledger, user, CreditRefund, path, prompt, held-actual)
+	case actual > held:
+		ok, _, err := ledger.SubtractCredits(ctx, path, user, actual-held)
+		if err != nil || !ok {
+			fmt.Printf("Failed to collect %d credits over reservation from user %s %v\n", actual-held, user, err)
+			recordCredit(ctx, ledger, user, CreditUnpaid, path, prompt, actual-held)
+			return
+		}
+		recordCredit(ctx, ledger, user, CreditCharge, path, prompt, actual-held)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenPricingCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing TokenPricing
+		usage   TokenUsage
+		want    int
+	}{
+		{
+			name:    "rounds up",
+			pricing: TokenPricing{InputPer1K: 1, OutputPer1K: 3},
+			usage:   TokenUsage{InputTokens: 1500, OutputTokens: 200},
+			want:    3,
+		},
+		{
+			name:    "exact",
+			pricing: TokenPricing{InputPer1K: 2, OutputPer1K: 4},
+			usage:   TokenUsage{InputTokens: 1000, OutputTokens: 500},
+			want:    4,
+		},
+		{
+			name:    "minimum",
+			pricing: TokenPricing{InputPer1K: 1, OutputPer1K: 1, Minimum: 5},
+			usage:   TokenUsage{InputTokens: 10, OutputTokens: 10},
+			want:    5,
+		},
+		{
+			name:    "no usage",
+			pricing: TokenPricing{InputPer1K: 1, OutputPer1K: 1},
+			want:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.pricing.Cost(tt.usage))
+		})
+	}
+}
+
+func TestTokenPricingReservation(t *testing.T) {
+	p := &PromptDeclaration{
+		MaxTokens:   2000,
+		System:      stringPtr(strings.Repeat("a", 2999)),
+		InitialUser: stringPtr("{{TEXT}}"),
+	}
+	vars := PromptVariables{"TEXT": strings.Repeat("b", 2993)}
+
+	estimated := TokenPricing{InputPer1K: 1, OutputPer1K: 2}
+	// 6000 bytes estimate 2001 input tokens, plus the full 2000 output
+	assert.Equal(t, 7, estimated.Reservation(p, vars))
+
+	fixed := TokenPricing{InputPer1K: 1, OutputPer1K: 2, Reserve: 50}
+	assert.Equal(t, 50, fixed.Reservation(p, vars))
+}
+
+func TestTokenPricingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing TokenPricing
+		wantErr bool
+	}{
+		{name: "rates", pricing: TokenPricing{InputPer1K: 0.5, OutputPer1K: 1.5}},
+		{name: "minimum only", pricing: TokenPricing{Minimum: 1}},
+		{name: "empty", pricing: TokenPricing{}, wantErr: true},
+		{name: "negative rate", pricing: TokenPricing{InputPer1K: -1, OutputPer1K: 1}, wantErr: true},
+		{name: "reserve below minimum", pricing: TokenPricing{OutputPer1K: 1, Minimum: 10, Reserve: 5}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.pricing.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	fcs "github.com/tmiv/firebase-credit-service"
 )
@@ -20,35 +21,71 @@ const (
 )
 
 type PromptVariables map[string]string
-type ModelExecutor func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, error)
+
+// ModelExecutor runs a prompt and returns the model context to seal, the
+// reply text, and the tokens used, which is nil when the vendor did not
+// report them.
+type ModelExecutor func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error)
 
 type PromptDeclaration struct {
-	Service            ServiceType     `json:"service"` // 'anthropic', 'openai', or 'gemini'
-	Model              string          `json:"model"`
-	System             *string         `json:"system,omitempty"`
-	MaxTokens          int             `json:"max_tokens"`
-	Temperature        float32         `json:"temperature"`
-	InitialUser        *string         `json:"initial_user,omitempty"`
-	InitialAgent       *string         `json:"initial_agent,omitempty"`
-	Cost               fcs.ChargeData  `json:"cost"`
-	ContinueCost       *fcs.ChargeData `json:"continue_cost,omitempty"`
-	RequiredScope      string          `json:"required_scope"`
-	Variables          []string        `json:"variables,omitempty"`
-	InitialCreditGrant int             `json:"initial_credit_grant"`
+	Service            ServiceType           `json:"service"` // 'anthropic', 'openai', or 'gemini'
+	Model              string                `json:"model"`
+	System             *string               `json:"system,omitempty"`
+	MaxTokens          int                   `json:"max_tokens"`
+	Temperature        float32               `json:"temperature"`
+	InitialUser        *string               `json:"initial_user,omitempty"`
+	InitialAgent       *string               `json:"initial_agent,omitempty"`
+	Cost               fcs.ChargeData        `json:"cost"`
+	ContinueCost       *fcs.ChargeData       `json:"continue_cost,omitempty"`
+	Pricing            *TokenPricing         `json:"pricing,omitempty"`    // charge by token usage instead of cost.cost
+	RateLimit          *RateLimits           `json:"rate_limit,omitempty"` // per user limits on this prompt
+	RequiredScope      string                `json:"required_scope"`
+	RequiredScopes     *ScopeExpr            `json:"required_scopes,omitempty"` // any_of/all_of expression, instead of required_scope
+	Variables          []VariableDeclaration `json:"variables,omitempty"`
+	ExposedClaims      []string              `json:"exposed_claims,omitempty"` // token claims templates may read as claims.<name>
+	InitialCreditGrant int                   `json:"initial_credit_grant"`
+	BaseURL            string                `json:"base_url,omitempty"`    // OpenAI compatible endpoint, e.g. http://vllm:8000/v1
+	APIKeyEnv          string                `json:"api_key_env,omitempty"` // environment variable holding the API key
+	ContextTTL         string                `json:"context_ttl,omitempty"` // Go duration a conversation may be continued for, e.g. "24h"
 }
 
 type Response struct {
-	Context string `json:"context"`
-	Result  string `json:"result"`
+	Context        string `json:"context,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"` // set instead of Context when a conversation store is configured
+	Result         string `json:"result"`
 }
 
+// PromptContext is the sealed payload of a continuation context.
 type PromptContext struct {
-	Prompt       string      `json:"prompt"`
-	ModelContext interface{} `json:"model_context"`
+	Version      int             `json:"v,omitempty"`
+	Provider     ServiceType     `json:"provider,omitempty"` // service that produced ModelContext
+	Prompt       string          `json:"prompt"`
+	ModelContext json.RawMessage `json:"model_context"`
+	IssuedAt     int64           `json:"issued_at,omitempty"`  // unix seconds the conversation started
+	ExpiresAt    int64           `json:"expires_at,omitempty"` // unix seconds after which it cannot be continued
 }
 
 type PromptConfig map[string]PromptDeclaration
 
+// apiKey returns the key named by api_key_env, falling back to the
+// service's default environment variable.
+func (pd *PromptDeclaration) apiKey(defaultEnv string) string {
+	if pd.APIKeyEnv != "" {
+		return os.Getenv(pd.APIKeyEnv)
+	}
+	return os.Getenv(defaultEnv)
+}
+
+// contextTTL is how long after a conversation starts it may be continued.
+// Zero means forever.
+func (pd *PromptDeclaration) contextTTL() time.Duration {
+	ttl, err := time.ParseDuration(pd.ContextTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
 func ValidatePromptDeclartion(name string, pd *PromptDeclaration) bool {
 	// Check if pointer is nil
 	if pd == nil {
@@ -57,13 +94,14 @@ func ValidatePromptDeclartion(name string, pd *PromptDeclaration) bool {
 	}
 
 	// Validate Service field
-	switch pd.Service {
-	case Anthropic, OpenAI, Gemini:
-		// Valid service type
-	default:
+	if pd.Service == "" {
 		fmt.Printf("service required for %s\n", name)
 		return false
 	}
+	if _, ok := LookupProvider(pd.Service); !ok {
+		fmt.Printf("service %s has no registered provider for %s\n", pd.Service, name)
+		return false
+	}
 
 	if pd.Model == "" {
 		fmt.Printf("model required for %s\n", name)
@@ -90,98 +128,137 @@ func ValidatePromptDeclartion(name string, pd *PromptDeclaration) bool {
 		return false
 	}
 
+	if pd.Pricing != nil {
+		if err := pd.Pricing.Validate(); err != nil {
+			fmt.Printf("pricing invalid for %s: %v\n", name, err)
+			return false
+		}
+		if pd.Pricing.Reserve > 0 && pd.Pricing.Reserve < pd.Pricing.MaxOutputCost(pd.MaxTokens) {
+			fmt.Printf("pricing invalid for %s: reserve does not cover max_tokens of output\n", name)
+			return false
+		}
+	}
+
+	if pd.RateLimit != nil {
+		if err := pd.RateLimit.Validate(); err != nil {
+			fmt.Printf("rate_limit invalid for %s: %v\n", name, err)
+			return false
+		}
+	}
+
 	if pd.System == nil && pd.InitialUser == nil {
 		fmt.Printf("system or initial user required for %s\n", name)
 		return false
 	}
 
-	if pd.RequiredScope == "" {
-		fmt.Printf("required_scope required for %s\n", name)
+	if (pd.RequiredScope == "") == (pd.RequiredScopes == nil) {
+		fmt.Printf("one of required_scope or required_scopes required for %s\n", name)
+		return false
+	}
+	if err := pd.scopeRequirement().Validate(); err != nil {
+		fmt.Printf("required scopes invalid for %s: %v\n", name, err)
 		return false
 	}
 
-	return true
-}
-
-func ValidatePromptConfig(pc *PromptConfig) bool {
-	for k, v := range *pc {
-		if !ValidatePromptDeclartion(k, &v) {
+	allowed := make(map[string]bool, len(pd.Variables))
+	for i := range pd.Variables {
+		vd := &pd.Variables[i]
+		if err := vd.Validate(); err != nil {
+			fmt.Printf("variables invalid for %s: %v\n", name, err)
 			return false
 		}
+		if allowed[vd.Name] {
+			fmt.Printf("variable %s declared twice for %s\n", vd.Name, name)
+			return false
+		}
+		allowed[vd.Name] = true
 	}
-	return true
-}
-
-func MakeResult(c []byte, r string) (*Response, error) {
-	var buf bytes.Buffer
-
-	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = zw.Write(c)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := zw.Close(); err != nil {
-		return nil, err
+	if err := validateExposedClaims(pd.ExposedClaims); err != nil {
+		fmt.Printf("exposed_claims invalid for %s: %v\n", name, err)
+		return false
 	}
-
-	compressed := buf.Bytes()
-	encrypted, err := Encrypt(compressed)
-	if err != nil {
-		return nil, err
+	for _, claim := range pd.ExposedClaims {
+		allowed[claimsVariable+"."+claim] = true
 	}
-
-	return &Response{
-		Context: base64.StdEncoding.EncodeToString(encrypted),
-		Result:  r,
-	}, nil
-}
-
-func UnpackContext(contextb64 string) (string, string, error) {
-	contextCompress, err := base64.StdEncoding.DecodeString(contextb64)
-	if err != nil {
-		return "", "", fmt.Errorf("decoding CONTEXT %v", err)
+	for field, text := range map[string]*string{"system": pd.System, "initial_user": pd.InitialUser, "initial_agent": pd.InitialAgent} {
+		if text == nil {
+			continue
+		}
+		if err := validatePromptTemplate(*text, allowed); err != nil {
+			fmt.Printf("%s template invalid for %s: %v\n", field, name, err)
+			return false
+		}
 	}
 
-	decrypted, err := Decrypt(contextCompress)
-	if err != nil {
-		return "", "", fmt.Errorf("decrypting context: %v", err)
+	if pd.ContextTTL != "" {
+		if ttl, err := time.ParseDuration(pd.ContextTTL); err != nil || ttl <= 0 {
+			fmt.Printf("context_ttl must be a positive duration for %s\n", name)
+			return false
+		}
 	}
 
-	zr, err := gzip.NewReader(bytes.NewReader(decrypted))
-	if err != nil {
-		return "", "", fmt.Errorf("creating gzip reader: %v", err)
+	if pd.BaseURL != "" {
+		if pd.Service != OpenAI {
+			fmt.Printf("base_url only supported for openai service in %s\n", name)
+			return false
+		}
+		u, err := url.Parse(pd.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Printf("base_url must be an absolute http(s) URL for %s\n", name)
+			return false
+		}
 	}
-	defer zr.Close()
 
-	var pc PromptContext
-	if err := json.NewDecoder(zr).Decode(&pc); err != nil {
-		return "", "", fmt.Errorf("decoding context JSON: %v", err)
-	}
+	return true
+}
 
-	context, err := json.Marshal(pc.ModelContext)
-	if err != nil {
-		return "", "", fmt.Errorf("unpacking model context: %v", err)
+func ValidatePromptConfig(pc *PromptConfig) bool {
+	for k, v := range *pc {
+		if !ValidatePromptDeclartion(k, &v) {
+			return false
+		}
 	}
-	return pc.Prompt, string(context), nil
+	return true
 }
 
-func CollectVariables(r *http.Request, p *PromptDeclaration) PromptVariables {
+func CollectVariables(r *http.Request, p *PromptDeclaration) (PromptVariables, error) {
 	vars := make(PromptVariables)
 	for key := range p.Variables {
-		varKey := p.Variables[key]
-		vars[varKey] = r.FormValue(varKey)
+		vd := &p.Variables[key]
+		value, err := vd.Resolve(r.FormValue(vd.Name))
+		if err != nil {
+			return nil, err
+		}
+		vars[vd.Name] = value
 	}
-	return vars
+	return vars, nil
 }
 
-func CollectContinuanceVariables(r *http.Request, context string) PromptVariables {
+func CollectContinuanceVariables(r *http.Request) PromptVariables {
 	vars := make(PromptVariables)
 	vars["USER_TEXT"] = r.FormValue("USER_TEXT")
-	vars["CONTEXT"] = context
+	vars["CONTEXT"] = r.FormValue("CONTEXT")
 	return vars
 }
+
+func collectLatestMessages(messages []messageParam) string {
+	var responses []string
+
+	// Iterate through messages in reverse order
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		if msg.Role != "assistant" {
+			break
+		}
+		responses = append(responses, msg.Content)
+	}
+
+	// Reverse the responses to maintain chronological order
+	for i := 0; i < len(responses)/2; i++ {
+		j := len(responses) - 1 - i
+		responses[i], responses[j] = responses[j], responses[i]
+	}
+
+	// Join all responses with newlines
+	return strings.Join(responses, "\n")
+}
@@ -24,7 +24,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 			Cost: 1,
 		},
 		Temperature:   0,
-		Variables:     []string{},
+		Variables:     []VariableDeclaration{},
 		RequiredScope: "hello",
 	}
 
@@ -55,7 +55,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -72,7 +72,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -89,7 +89,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -106,7 +106,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -123,7 +123,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: -1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -139,7 +139,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: true,
@@ -156,11 +156,126 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature:   0,
-				Variables:     []string{},
+				Variables:     []VariableDeclaration{},
 				RequiredScope: "hello",
 			},
 			wantErr: false,
 		},
+		{
+			name: "openai compatible base url",
+			prompt: &PromptDeclaration{
+				Service:     OpenAI,
+				Model:       "llama-3-8b",
+				InitialUser: strPtr("Hello, AI"),
+				MaxTokens:   1000,
+				Cost: fcs.ChargeData{
+					Path: "test/path",
+					Cost: 1,
+				},
+				Temperature:   0,
+				Variables:     []VariableDeclaration{},
+				RequiredScope: "hello",
+				BaseURL:       "http://localhost:8000/v1",
+				APIKeyEnv:     "LOCAL_LLM_KEY",
+			},
+			wantErr: false,
+		},
+		{
+			name: "relative base url",
+			prompt: &PromptDeclaration{
+				Service:     OpenAI,
+				Model:       "llama-3-8b",
+				InitialUser: strPtr("Hello, AI"),
+				MaxTokens:   1000,
+				Cost: fcs.ChargeData{
+					Path: "test/path",
+					Cost: 1,
+				},
+				Temperature:   0,
+				Variables:     []VariableDeclaration{},
+				RequiredScope: "hello",
+				BaseURL:       "localhost/v1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "base url on anthropic service",
+			prompt: &PromptDeclaration{
+				Service:     Anthropic,
+				Model:       "claude-3",
+				InitialUser: strPtr("Hello, AI"),
+				MaxTokens:   1000,
+				Cost: fcs.ChargeData{
+					Path: "test/path",
+					Cost: 1,
+				},
+				Temperature:   0,
+				Variables:     []VariableDeclaration{},
+				RequiredScope: "hello",
+				BaseURL:       "http://localhost:8000/v1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "template syntax error",
+			prompt: &PromptDeclaration{
+				Service:   Anthropic,
+				Model:     "claude-3",
+				System:    strPtr("Hello {{if .NAME}}"),
+				MaxTokens: 1000,
+				Cost: fcs.ChargeData{
+					Path: "test/path",
+					Cost: 1,
+				},
+				Temperature:   0,
+				Variables:     []VariableDeclaration{{Name: "NAME"}},
+				RequiredScope: "hello",
+			},
+			wantErr: true,
+		},
+		{
+			name: "template references undeclared variable",
+			prompt: &PromptDeclaration{
+				Service:   Anthropic,
+				Model:     "claude-3",
+				System:    strPtr("Hello {{NAME}}"),
+				MaxTokens: 1000,
+				Cost: fcs.ChargeData{
+					Path: "test/path",
+					Cost: 1,
+				},
+				Temperature:   0,
+				Variables:     []VariableDeclaration{},
+				RequiredScope: "hello",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid pricing",
+			prompt: &PromptDeclaration{
+				Service:       Anthropic,
+				Model:         "claude-3",
+				InitialUser:   strPtr("Hello, AI"),
+				MaxTokens:     1000,
+				Cost:          fcs.ChargeData{Path: "test/path"},
+				Pricing:       &TokenPricing{InputPer1K: -1},
+				RequiredScope: "hello",
+			},
+			wantErr: true,
+		},
+		{
+			name: "reserve below max output",
+			prompt: &PromptDeclaration{
+				Service:       Anthropic,
+				Model:         "claude-3",
+				InitialUser:   strPtr("Hello, AI"),
+				MaxTokens:     1000,
+				Cost:          fcs.ChargeData{Path: "test/path"},
+				Pricing:       &TokenPricing{OutputPer1K: 3, Reserve: 2},
+				RequiredScope: "hello",
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing required scope",
 			prompt: &PromptDeclaration{
@@ -173,7 +288,7 @@ func TestValidatePromptDeclaration(t *testing.T) {
 					Cost: 1,
 				},
 				Temperature: 0,
-				Variables:   []string{},
+				Variables:   []VariableDeclaration{},
 			},
 			wantErr: true,
 		},
@@ -204,7 +319,7 @@ func TestValidatePromptConfig(t *testing.T) {
 			Cost: 1,
 		},
 		Temperature:   0,
-		Variables:     []string{},
+		Variables:     []VariableDeclaration{},
 		RequiredScope: "hello",
 	}
 
@@ -218,7 +333,7 @@ func TestValidatePromptConfig(t *testing.T) {
 			Cost: 1,
 		},
 		Temperature:   0,
-		Variables:     []string{},
+		Variables:     []VariableDeclaration{},
 		RequiredScope: "hello",
 	}
 
@@ -277,7 +392,7 @@ func TestMakeResult(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := MakeResult(tt.context, tt.result)
+			got, err := MakeResult("user1", "test", tt.context, tt.result)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("MakeResult() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -340,9 +455,15 @@ func TestCollectVariables(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := createTestRequest(tt.formValues)
-			p := &PromptDeclaration{Variables: tt.variables}
+			p := &PromptDeclaration{}
+			for _, name := range tt.variables {
+				p.Variables = append(p.Variables, VariableDeclaration{Name: name})
+			}
 
-			got := CollectVariables(r, p)
+			got, err := CollectVariables(r, p)
+			if err != nil {
+				t.Fatalf("CollectVariables() unexpected error %v", err)
+			}
 
 			if len(got) != len(tt.wantVars) {
 				t.Errorf("CollectVariables() got %v vars, want %v", len(got), len(tt.wantVars))
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	openaiChatEndpoint = "https://api.openai.com/v1/chat/completions"
+)
+
+type openaiRequest struct {
+	Model       string         `json:"model"`
+	MaxTokens   int            `json:"max_tokens"`
+	Temperature float32        `json:"temperature"`
+	Messages    []messageParam `json:"messages"`
+}
+
+type openaiResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int          `json:"index"`
+		Message      messageParam `json:"message"`
+		FinishReason string       `json:"finish_reason"`
+	} `json:"choices"`
+	// many compatible servers leave usage out
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error,omitempty"`
+}
+
+func buildOpenAIRequest(p *PromptDeclaration, vars PromptVariables) (*openaiRequest, []byte, error) {
+	reqBody := openaiRequest{
+		Model:       p.Model,
+		MaxTokens:   p.MaxTokens,
+		Temperature: p.Temperature,
+		Messages:    []messageParam{},
+	}
+
+	rendered, err := renderPrompt(p, vars)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error rendering prompt: %w", err)
+	}
+
+	// The system prompt travels as the first chat message
+	if rendered.System != nil {
+		reqBody.Messages = append(reqBody.Messages, messageParam{
+			Role:    "system",
+			Content: *rendered.System,
+		})
+	}
+	if rendered.InitialUser != nil {
+		reqBody.Messages = append(reqBody.Messages, messageParam{
+			Role:    "user",
+			Content: *rendered.InitialUser,
+		})
+	}
+	if rendered.InitialAgent != nil {
+		reqBody.Messages = append(reqBody.Messages, messageParam{
+			Role:    "assistant",
+			Content: *rendered.InitialAgent,
+		})
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	return &reqBody, jsonBody, nil
+}
+
+func buildOpenAIContinueRequest(p *PromptDeclaration, vars PromptVariables) (*openaiRequest, []byte, error) {
+	var reqBody openaiRequest
+
+	context, ok := vars["CONTEXT"]
+	if !ok {
+		return nil, nil, fmt.Errorf("no CONTEXT")
+	}
+	text, ok := vars["USER_TEXT"]
+	if !ok {
+		return nil, nil, fmt.Errorf("no USER_TEXT")
+	}
+	err := json.Unmarshal([]byte(context), &reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal context: %v", err)
+	}
+
+	reqBody.Messages = append(reqBody.Messages, messageParam{
+		Content: text,
+		Role:    "user",
+	})
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	return &reqBody, jsonBody, nil
+}
+
+func openaiEndpoint(p *PromptDeclaration) string {
+	if p.BaseURL != "" {
+		return strings.TrimRight(p.BaseURL, "/") + "/chat/completions"
+	}
+	return openaiChatEndpoint
+}
+
+func sendToOpenAI(p *PromptDeclaration, reqBody *openaiRequest, jsonBody []byte) (interface{}, string, *TokenUsage, error) {
+	req, err := http.NewRequest("POST", openaiEndpoint(p), bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	// Self-hosted compatible servers frequently run without a key
+	if key := p.apiKey("OPENAI_API_KEY"); key != "" {
+		req.Header.Set("authorization", "Bearer "+key)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return packageOpenAIResult(resp, reqBody)
+}
+
+func OpenAIProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	reqBody, jsonBody, err := buildOpenAIRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToOpenAI(p, reqBody, jsonBody)
+}
+
+func OpenAIContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	reqBody, jsonBody, err := buildOpenAIContinueRequest(p, vars)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error creating request content: %w", err)
+	}
+	return sendToOpenAI(p, reqBody, jsonBody)
+}
+
+func packageOpenAIResult(resp *http.Response, reqBody *openaiRequest) (interface{}, string, *TokenUsage, error) {
+	var oaiResponse openaiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&oaiResponse); err != nil {
+		return nil, "", nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	if oaiResponse.Error != nil {
+		return nil, "", nil, fmt.Errorf("API error: %s", oaiResponse.Error.Message)
+	}
+
+	if len(oaiResponse.Choices) == 0 {
+		return nil, "", nil, fmt.Errorf("no choices in response")
+	}
+
+	reqBody.Messages = append(reqBody.Messages, messageParam{
+		Role:    "assistant",
+		Content: oaiResponse.Choices[0].Message.Content,
+	})
+	result := collectLatestMessages(reqBody.Messages)
+
+	var usage *TokenUsage
+	if oaiResponse.Usage != nil {
+		usage = &TokenUsage{InputTokens: oaiResponse.Usage.PromptTokens, OutputTokens: oaiResponse.Usage.CompletionTokens}
+	}
+	return *reqBody, result, usage, nil
+}
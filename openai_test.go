@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func TestBuildOpenAIRequest(t *testing.T) {
+	p := &PromptDeclaration{
+		Model:        "gpt-4o",
+		MaxTokens:    500,
+		Temperature:  0.5,
+		System:       stringPtr("System {{VAR}}"),
+		InitialUser:  stringPtr("User {{VAR}}"),
+		InitialAgent: stringPtr("Agent {{VAR}}"),
+	}
+
+	req, _, err := buildOpenAIRequest(p, PromptVariables{"VAR": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o", req.Model)
+	assert.Equal(t, 500, req.MaxTokens)
+	assert.Equal(t, float32(0.5), req.Temperature)
+	assert.Equal(t, []messageParam{
+		{Role: "system", Content: "System test"},
+		{Role: "user", Content: "User test"},
+		{Role: "assistant", Content: "Agent test"},
+	}, req.Messages)
+}
+
+func TestBuildOpenAIContinueRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		context string
+		text    string
+		wantErr bool
+	}{
+		{
+			name: "valid continue request",
+			context: `{
+				"model": "gpt-4o",
+				"messages": [
+					{"role": "system", "content": "Be nice"},
+					{"role": "user", "content": "Hello"},
+					{"role": "assistant", "content": "Hi"}
+				]
+			}`,
+			text: "How are you?",
+		},
+		{
+			name:    "missing context",
+			context: "",
+			text:    "test",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := PromptVariables{
+				"CONTEXT":   tt.context,
+				"USER_TEXT": tt.text,
+			}
+			req, _, err := buildOpenAIContinueRequest(&PromptDeclaration{}, vars)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "system", req.Messages[0].Role)
+			assert.Equal(t, tt.text, req.Messages[len(req.Messages)-1].Content)
+		})
+	}
+}
+
+func TestPackageOpenAIResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		respBody   string
+		wantErr    bool
+		wantResult string
+		wantUsage  *TokenUsage
+	}{
+		{
+			name: "successful response",
+			respBody: `{
+				"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello!"}, "finish_reason": "stop"}],
+				"usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}
+			}`,
+			wantResult: "Hello!",
+			wantUsage:  &TokenUsage{InputTokens: 5, OutputTokens: 2},
+		},
+		{
+			name: "response without usage",
+			respBody: `{
+				"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello!"}, "finish_reason": "stop"}]
+			}`,
+			wantResult: "Hello!",
+		},
+		{
+			name: "error response",
+			respBody: `{
+				"error": {"message": "Invalid request", "type": "invalid_request_error"}
+			}`,
+			wantErr: true,
+		},
+		{
+			name:     "no choices",
+			respBody: `{"choices": []}`,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Body: io.NopCloser(strings.NewReader(tt.respBody)),
+			}
+			reqBody := &openaiRequest{
+				Messages: []messageParam{
+					{Role: "user", Content: "Hi"},
+				},
+			}
+
+			_, result, usage, err := packageOpenAIResult(resp, reqBody)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantResult, result)
+			assert.Equal(t, tt.wantUsage, usage)
+		})
+	}
+}
+
+func TestOpenAIProcessAndContinue(t *testing.T) {
+	var received openaiRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test-key", r.Header.Get("authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "reply"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	originalEndpoint := openaiChatEndpoint
+	openaiChatEndpoint = mockServer.URL
+	defer func() { openaiChatEndpoint = originalEndpoint }()
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	p := &PromptDeclaration{
+		Service:     OpenAI,
+		Model:       "gpt-4o",
+		MaxTokens:   100,
+		System:      stringPtr("Be brief"),
+		InitialUser: stringPtr("Hello {{NAME}}"),
+	}
+
+	modelContext, result, _, err := OpenAIProcessPrompt(p, PromptVariables{"NAME": "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", result)
+	assert.Equal(t, "Hello bob", received.Messages[1].Content)
+
+	contextJson, err := json.Marshal(modelContext)
+	assert.NoError(t, err)
+
+	vars := PromptVariables{
+		"CONTEXT":   string(contextJson),
+		"USER_TEXT": "And again",
+	}
+	_, result, _, err = OpenAIContinuePrompt(p, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", result)
+	assert.Equal(t, 4, len(received.Messages))
+	assert.Equal(t, "assistant", received.Messages[2].Role)
+	assert.Equal(t, "And again", received.Messages[3].Content)
+}
+
+func TestOpenAICompatibleEndpoint(t *testing.T) {
+	var receivedPath, receivedAuth string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		receivedAuth = r.Header.Get("authorization")
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "local reply"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name      string
+		apiKeyEnv string
+		keyValue  string
+		wantAuth  string
+	}{
+		{
+			name:      "custom key variable",
+			apiKeyEnv: "LOCAL_LLM_KEY",
+			keyValue:  "local-key",
+			wantAuth:  "Bearer local-key",
+		},
+		{
+			name:      "no key configured",
+			apiKeyEnv: "UNSET_LOCAL_LLM_KEY",
+			wantAuth:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.keyValue != "" {
+				t.Setenv(tt.apiKeyEnv, tt.keyValue)
+			}
+			p := &PromptDeclaration{
+				Service:     OpenAI,
+				Model:       "llama-3-8b",
+				MaxTokens:   100,
+				InitialUser: stringPtr("Hello"),
+				BaseURL:     mockServer.URL + "/v1/",
+				APIKeyEnv:   tt.apiKeyEnv,
+			}
+
+			_, result, _, err := OpenAIProcessPrompt(p, PromptVariables{})
+			assert.NoError(t, err)
+			assert.Equal(t, "local reply", result)
+			assert.Equal(t, "/v1/chat/completions", receivedPath)
+			assert.Equal(t, tt.wantAuth, receivedAuth)
+		})
+	}
+}
+
+func TestOpenAICompatibleEndpointWithoutUsageKeepsReservation(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "local reply"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	ledger := useTestLedger(t)
+	ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+	ledger.AddCredits(ctx, "app/credits", "alice", 20)
+
+	p := &PromptDeclaration{
+		Service:     OpenAI,
+		Model:       "llama-3-8b",
+		MaxTokens:   10,
+		InitialUser: stringPtr("Hello"),
+		BaseURL:     mockServer.URL + "/v1/",
+		APIKeyEnv:   "UNSET_LOCAL_LLM_KEY",
+		Cost:        fcs.ChargeData{Path: "app/credits"},
+		Pricing:     &TokenPricing{OutputPer1K: 1000, Reserve: 10},
+	}
+	w := httptest.NewRecorder()
+	runFunc(ctx, &p.Cost, "chat", p, PromptVariables{}, OpenAIProcessPrompt, nil, w)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// with nothing to settle against, the reservation is the charge
+	balance, _ := ledger.Balance(ctx, "app/credits", "alice")
+	assert.Equal(t, 10, balance)
+}
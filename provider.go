@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultUpstreamTimeout = 5 * time.Minute
+
+// providerClient makes every request to a model vendor. Its timeout bounds
+// the whole call, a streamed reply included, so a stalled provider fails with
+// upstream_timeout rather than holding the request and its credits open.
+var providerClient = &http.Client{Timeout: defaultUpstreamTimeout}
+
+func init() {
+	timeout, err := durationEnv("UPSTREAM_TIMEOUT", defaultUpstreamTimeout)
+	if err != nil {
+		panic(err.Error())
+	}
+	if timeout <= 0 {
+		panic(fmt.Sprintf("UPSTREAM_TIMEOUT must be positive, got %s", timeout))
+	}
+	providerClient.Timeout = timeout
+}
+
+// Provider executes prompts against a model vendor. ProcessPrompt starts a
+// new conversation from a PromptDeclaration and ContinuePrompt appends
+// USER_TEXT to the conversation packed in the CONTEXT variable. Both return
+// the same values as a ModelExecutor.
+type Provider interface {
+	ProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error)
+	ContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error)
+}
+
+// ExecutorProvider adapts a pair of ModelExecutor functions to Provider.
+type ExecutorProvider struct {
+	Process  ModelExecutor
+	Continue ModelExecutor
+}
+
+func (e ExecutorProvider) ProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	return e.Process(p, vars)
+}
+
+func (e ExecutorProvider) ContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	return e.Continue(p, vars)
+}
+
+var providers = map[ServiceType]Provider{
+	Anthropic: anthropicProvider{},
+	OpenAI:    ExecutorProvider{OpenAIProcessPrompt, OpenAIContinuePrompt},
+	Gemini:    ExecutorProvider{GeminiProcessPrompt, GeminiContinuePrompt},
+}
+
+// RegisterProvider makes a provider available to prompts declaring service s.
+// It must be called before the prompt configuration is validated.
+func RegisterProvider(s ServiceType, provider Provider) {
+	providers[s] = provider
+}
+
+func LookupProvider(s ServiceType) (Provider, bool) {
+	provider, ok := providers[s]
+	return provider, ok
+}
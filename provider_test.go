@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+type fakeProvider struct {
+	processed int
+	continued int
+}
+
+func (f *fakeProvider) ProcessPrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	f.processed++
+	return map[string]string{"history": "start"}, "processed " + vars["NAME"], nil, nil
+}
+
+func (f *fakeProvider) ContinuePrompt(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+	f.continued++
+	return map[string]string{"history": "more"}, "continued " + vars["USER_TEXT"], nil, nil
+}
+
+func TestLookupProvider(t *testing.T) {
+	for _, s := range []ServiceType{Anthropic, OpenAI, Gemini} {
+		_, ok := LookupProvider(s)
+		assert.True(t, ok, "provider for %s", s)
+	}
+	_, ok := LookupProvider("unregistered")
+	assert.False(t, ok)
+}
+
+func TestRegisteredProviderHandlers(t *testing.T) {
+	const fakeService = ServiceType("fake")
+	fake := &fakeProvider{}
+	RegisterProvider(fakeService, fake)
+	defer delete(providers, fakeService)
+
+	p := PromptDeclaration{
+		Service:       fakeService,
+		Model:         "fake-model",
+		MaxTokens:     10,
+		InitialUser:   stringPtr("Hi {{NAME}}"),
+		Cost:          fcs.ChargeData{Path: "test/path"},
+		RequiredScope: "hello",
+		Variables:     []VariableDeclaration{{Name: "NAME"}},
+	}
+	assert.True(t, ValidatePromptDeclartion("fake", &p))
+
+	req := createTestRequest(map[string]string{"NAME": "bob"})
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+	w := httptest.NewRecorder()
+	constructPromptHandler("fake", &p).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "processed bob", resp.Result)
+	assert.Equal(t, 1, fake.processed)
+
+	req = createTestRequest(map[string]string{"USER_TEXT": "again"})
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+	w = httptest.NewRecorder()
+	continuanceConstructor("fake", &p, `{"history":"start"}`).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "continued again", resp.Result)
+	assert.Equal(t, 1, fake.continued)
+}
+
+func TestUnregisteredProviderNotImplemented(t *testing.T) {
+	p := PromptDeclaration{Service: "unregistered"}
+	w := httptest.NewRecorder()
+	constructPromptHandler("unregistered", &p).ServeHTTP(w, createTestRequest(nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	assert.False(t, ValidatePromptDeclartion("unregistered", &p))
+}
+
+func TestProviderTimeout(t *testing.T) {
+	saved := providerClient.Timeout
+	providerClient.Timeout = 50 * time.Millisecond
+	defer func() { providerClient.Timeout = saved }()
+
+	tests := []struct {
+		name        string
+		sendHeaders bool
+	}{
+		{name: "stalls before responding"},
+		{name: "stalls mid reply", sendHeaders: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.sendHeaders {
+					w.Header().Set("content-type", "application/json")
+					w.Write([]byte(`{"content": [`))
+					w.(http.Flusher).Flush()
+				}
+				<-release
+			}))
+			defer mockServer.Close()
+			defer close(release)
+
+			originalEndpoint := anthropicMessageEndpoint
+			anthropicMessageEndpoint = mockServer.URL
+			defer func() { anthropicMessageEndpoint = originalEndpoint }()
+
+			p := &PromptDeclaration{Service: Anthropic, Model: "claude-3", MaxTokens: 100, InitialUser: stringPtr("Hi")}
+			ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				runFunc(ctx, nil, "chat", p, PromptVariables{}, anthropicProvider{}.ProcessPrompt, nil, w)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request to a stalled provider did not time out")
+			}
+			assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+			assert.Contains(t, w.Body.String(), string(ErrUpstreamTimeout))
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// RateLimits caps how hard one user may drive a prompt, or every prompt
+// together when set globally with RATE_LIMITS. Zero leaves a limit off.
+type RateLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	Burst             int `json:"burst,omitempty"` // requests allowed at once after a quiet spell; defaults to requests_per_minute
+	Concurrent        int `json:"concurrent,omitempty"`
+	DailyTokens       int `json:"daily_tokens,omitempty"` // model tokens per UTC day, as reported by the provider
+}
+
+func (rl *RateLimits) Validate() error {
+	if rl.RequestsPerMinute < 0 || rl.Burst < 0 || rl.Concurrent < 0 || rl.DailyTokens < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if rl.Burst > 0 && rl.RequestsPerMinute == 0 {
+		return fmt.Errorf("burst needs requests_per_minute")
+	}
+	return nil
+}
+
+func (rl *RateLimits) burst() int {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return rl.RequestsPerMinute
+}
+
+// RateBucket is a token bucket at Key that refills at Rate tokens a second
+// up to Burst.
+type RateBucket struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// RateLimitStore holds limiter state. The memory store suits a single
+// instance; a shared store lets several instances enforce one limit.
+type RateLimitStore interface {
+	// Take removes a token from every bucket, or from none if any of them
+	// is empty, in which case it reports how long until all have one.
+	Take(ctx context.Context, buckets []RateBucket) (bool, time.Duration, error)
+	// Acquire takes one of limit concurrent slots at key.
+	Acquire(ctx context.Context, key string, limit int) (bool, error)
+	// Release gives back a slot taken by Acquire.
+	Release(ctx context.Context, key string) error
+	// DailyTokens returns the tokens counted at key on day.
+	DailyTokens(ctx context.Context, key string, day string) (int, error)
+	// AddDailyTokens counts tokens at key on day.
+	AddDailyTokens(ctx context.Context, key string, day string, tokens int) error
+}
+
+// rateLimitError is a request turned away, and when to try again.
+type rateLimitError struct {
+	limit      string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded", e.limit)
+}
+
+// retryAfterSeconds is the Retry-After header value, rounded up.
+func (e *rateLimitError) retryAfterSeconds() string {
+	return fmt.Sprintf("%d", int(math.Max(1, math.Ceil(e.retryAfter.Seconds()))))
+}
+
+type rateLimiter struct {
+	store  RateLimitStore
+	global *RateLimits
+	now    func() time.Time
+}
+
+var limiter *rateLimiter
+
+func init() {
+	global, err := parseRateLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		panic(err.Error())
+	}
+	limiter = &rateLimiter{store: newMemoryRateLimitStore(), global: global, now: time.Now}
+}
+
+func parseRateLimits(limitsJson string) (*RateLimits, error) {
+	if limitsJson == "" {
+		return nil, nil
+	}
+	var limits RateLimits
+	if err := json.Unmarshal([]byte(limitsJson), &limits); err != nil {
+		return nil, fmt.Errorf("RATE_LIMITS must be a JSON object: %v", err)
+	}
+	if err := limits.Validate(); err != nil {
+		return nil, fmt.Errorf("RATE_LIMITS invalid: %v", err)
+	}
+	return &limits, nil
+}
+
+// scopedLimits pairs each limit that applies to a prompt with the key its
+// state is kept under for user.
+func (l *rateLimiter) scopedLimits(name string, p *PromptDeclaration, user string) (keys []string, limits []*RateLimits) {
+	if l.global != nil {
+		keys = append(keys, "global\x00"+user)
+		limits = append(limits, l.global)
+	}
+	if p.RateLimit != nil {
+		keys = append(keys, "prompt\x00"+name+"\x00"+user)
+		limits = append(limits, p.RateLimit)
+	}
+	return keys, limits
+}
+
+func (l *rateLimiter) day() (string, time.Duration) {
+	now := l.now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return now.Format("2006-01-02"), midnight.Sub(now)
+}
+
+// admit checks user against the global and prompt limits. On success the
+// caller must call release once the request is over. Store failures let
+// the request through rather than take the service down with them.
+func (l *rateLimiter) admit(ctx context.Context, name string, p *PromptDeclaration, user string) (release func(), limited *rateLimitError) {
+	keys, limits := l.scopedLimits(name, p, user)
+	var held []string
+	release = func() {
+		for _, key := range held {
+			if err := l.store.Release(ctx, key); err != nil {
+				fmt.Printf("failed to release concurrency slot %v\n", err)
+			}
+		}
+	}
+
+	day, untilTomorrow := l.day()
+	for i, rl := range limits {
+		if rl.DailyTokens == 0 {
+			continue
+		}
+		used, err := l.store.DailyTokens(ctx, keys[i], day)
+		if err != nil {
+			fmt.Printf("rate limit store failed %v\n", err)
+			continue
+		}
+		if used >= rl.DailyTokens {
+			return nil, &rateLimitError{limit: "daily token", retryAfter: untilTomorrow}
+		}
+	}
+
+	for i, rl := range limits {
+		if rl.Concurrent == 0 {
+			continue
+		}
+		ok, err := l.store.Acquire(ctx, keys[i], rl.Concurrent)
+		if err != nil {
+			fmt.Printf("rate limit store failed %v\n", err)
+			continue
+		}
+		if !ok {
+			release()
+			return nil, &rateLimitError{limit: "concurrent request", retryAfter: time.Second}
+		}
+		held = append(held, keys[i])
+	}
+
+	// all buckets are taken from together, so a request refused by its
+	// prompt's rate does not spend the user's global allowance
+	var buckets []RateBucket
+	for i, rl := range limits {
+		if rl.RequestsPerMinute > 0 {
+			buckets = append(buckets, RateBucket{Key: keys[i], Rate: float64(rl.RequestsPerMinute) / 60, Burst: rl.burst()})
+		}
+	}
+	if len(buckets) > 0 {
+		ok, wait, err := l.store.Take(ctx, buckets)
+		if err != nil {
+			fmt.Printf("rate limit store failed %v\n", err)
+		} else if !ok {
+			release()
+			return nil, &rateLimitError{limit: "request rate", retryAfter: wait}
+		}
+	}
+	return release, nil
+}
+
+// recordUsage counts a call's tokens toward any daily caps.
+func (l *rateLimiter) recordUsage(ctx context.Context, name string, p *PromptDeclaration, user string, usage TokenUsage) {
+	keys, limits := l.scopedLimits(name, p, user)
+	day, _ := l.day()
+	for i, rl := range limits {
+		if rl.DailyTokens == 0 {
+			continue
+		}
+		if err := l.store.AddDailyTokens(ctx, keys[i], day, usage.InputTokens+usage.OutputTokens); err != nil {
+			fmt.Printf("failed to count daily tokens %v\n", err)
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will have refilled, after which it can go
+}
+
+type dailyCount struct {
+	day    string
+	tokens int
+}
+
+// memoryRateLimitStore keeps limiter state for this instance only.
+type memoryRateLimitStore struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	concurrent map[string]int
+	daily      map[string]dailyCount
+	takes      int
+	now        func() time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets:    make(map[string]*tokenBucket),
+		concurrent: make(map[string]int),
+		daily:      make(map[string]dailyCount),
+		now:        time.Now,
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, buckets []RateBucket) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.takes++
+	if s.takes%1000 == 0 {
+		// a refilled bucket is no different from a missing one
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	refilled := make([]*tokenBucket, len(buckets))
+	var wait time.Duration
+	for i, spec := range buckets {
+		b, ok := s.buckets[spec.Key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(spec.Burst), last: now}
+			s.buckets[spec.Key] = b
+		}
+		b.tokens = math.Min(float64(spec.Burst), b.tokens+now.Sub(b.last).Seconds()*spec.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / spec.Rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+		refilled[i] = b
+	}
+	if wait > 0 {
+		return false, wait, nil
+	}
+	for i, b := range refilled {
+		b.tokens--
+		b.full = now.Add(time.Duration((float64(buckets[i].Burst) - b.tokens) / buckets[i].Rate * float64(time.Second)))
+	}
+	return true, 0, nil
+}
+
+func (s *memoryRateLimitStore) Acquire(ctx context.Context, key string, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.concurrent[key] >= limit {
+		return false, nil
+	}
+	s.concurrent[key]++
+	return true, nil
+}
+
+func (s *memoryRateLimitStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.concurrent[key] <= 1 {
+		delete(s.concurrent, key)
+		return nil
+	}
+	s.concurrent[key]--
+	return nil
+}
+
+func (s *memoryRateLimitStore) DailyTokens(ctx context.Context, key string, day string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.daily[key]; ok && c.day == day {
+		return c.tokens, nil
+	}
+	return 0, nil
+}
+
+func (s *memoryRateLimitStore) AddDailyTokens(ctx context.Context, key string, day string, tokens int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.daily[key]
+	if c.day != day {
+		// counts from earlier days are only ever replaced, so the map
+		// stays one entry per capped user and prompt
+		c = dailyCount{day: day}
+	}
+	c.tokens += tokens
+	s.daily[key] = c
+	return nil
+}
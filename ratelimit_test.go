@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+// useTestLimiter swaps in a limiter with its own store and a clock the test
+// moves by hand.
+func useTestLimiter(t *testing.T, global *RateLimits) (*rateLimiter, *time.Time) {
+	t.Helper()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := newMemoryRateLimitStore()
+	store.now = clock
+	saved := limiter
+	limiter = &rateLimiter{store: store, global: global, now: clock}
+	t.Cleanup(func() { limiter = saved })
+	return limiter, &now
+}
+
+func TestRateLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  RateLimits
+		wantErr bool
+	}{
+		{name: "all set", limits: RateLimits{RequestsPerMinute: 10, Burst: 20, Concurrent: 2, DailyTokens: 1000}},
+		{name: "empty", limits: RateLimits{}},
+		{name: "negative", limits: RateLimits{Concurrent: -1}, wantErr: true},
+		{name: "burst without rate", limits: RateLimits{Burst: 5}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	_, err := parseRateLimits(`{"requests_per_minute": "lots"}`)
+	assert.Error(t, err)
+	limits, err := parseRateLimits(`{"requests_per_minute": 30}`)
+	assert.NoError(t, err)
+	assert.Equal(t, &RateLimits{RequestsPerMinute: 30}, limits)
+}
+
+func TestMemoryTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	k := []RateBucket{{Key: "k", Rate: 1, Burst: 2}}
+	for i := 0; i < 2; i++ {
+		ok, _, err := store.Take(ctx, k)
+		assert.NoError(t, err)
+		assert.True(t, ok, "take %d", i)
+	}
+	ok, wait, err := store.Take(ctx, k)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	ok, _, _ = store.Take(ctx, []RateBucket{{Key: "other", Rate: 1, Burst: 2}})
+	assert.True(t, ok, "buckets are per key")
+
+	now = now.Add(time.Second)
+	ok, _, _ = store.Take(ctx, k)
+	assert.True(t, ok)
+
+	// an empty bucket leaves the others untouched
+	both := []RateBucket{{Key: "wide", Rate: 1, Burst: 1}, {Key: "k", Rate: 1, Burst: 2}}
+	ok, _, _ = store.Take(ctx, both)
+	assert.False(t, ok)
+	ok, _, _ = store.Take(ctx, both[:1])
+	assert.True(t, ok, "refused take spent a token")
+}
+
+func TestRateLimiterAdmit(t *testing.T) {
+	ctx := context.Background()
+	p := &PromptDeclaration{RateLimit: &RateLimits{Concurrent: 1, DailyTokens: 100}}
+
+	t.Run("concurrent", func(t *testing.T) {
+		l, _ := useTestLimiter(t, nil)
+		release, limited := l.admit(ctx, "chat", p, "alice")
+		assert.Nil(t, limited)
+		_, limited = l.admit(ctx, "chat", p, "alice")
+		if assert.NotNil(t, limited) {
+			assert.Equal(t, "concurrent request limit exceeded", limited.Error())
+		}
+		_, limited = l.admit(ctx, "chat", p, "bob")
+		assert.Nil(t, limited, "limits are per user")
+		release()
+		release, limited = l.admit(ctx, "chat", p, "alice")
+		assert.Nil(t, limited)
+		release()
+	})
+
+	t.Run("daily tokens", func(t *testing.T) {
+		l, now := useTestLimiter(t, nil)
+		release, limited := l.admit(ctx, "chat", p, "alice")
+		assert.Nil(t, limited)
+		l.recordUsage(ctx, "chat", p, "alice", TokenUsage{InputTokens: 60, OutputTokens: 40})
+		release()
+
+		_, limited = l.admit(ctx, "chat", p, "alice")
+		if assert.NotNil(t, limited) {
+			assert.Equal(t, 12*time.Hour, limited.retryAfter)
+			assert.Equal(t, "43200", limited.retryAfterSeconds())
+		}
+
+		*now = now.Add(12 * time.Hour)
+		release, limited = l.admit(ctx, "chat", p, "alice")
+		assert.Nil(t, limited, "cap resets at UTC midnight")
+		release()
+	})
+
+	t.Run("global across prompts", func(t *testing.T) {
+		l, _ := useTestLimiter(t, &RateLimits{RequestsPerMinute: 1})
+		release, limited := l.admit(ctx, "chat", &PromptDeclaration{}, "alice")
+		assert.Nil(t, limited)
+		release()
+		_, limited = l.admit(ctx, "summary", &PromptDeclaration{}, "alice")
+		if assert.NotNil(t, limited) {
+			assert.Equal(t, time.Minute, limited.retryAfter)
+		}
+	})
+
+	t.Run("prompt refusal spares global", func(t *testing.T) {
+		l, _ := useTestLimiter(t, &RateLimits{RequestsPerMinute: 5})
+		tight := &PromptDeclaration{RateLimit: &RateLimits{RequestsPerMinute: 1}}
+		release, limited := l.admit(ctx, "tight", tight, "alice")
+		assert.Nil(t, limited)
+		release()
+		for i := 0; i < 4; i++ {
+			_, limited = l.admit(ctx, "tight", tight, "alice")
+			assert.NotNil(t, limited, "attempt %d", i)
+		}
+		// one global token used, four left for other prompts
+		for i := 0; i < 4; i++ {
+			release, limited = l.admit(ctx, "other", &PromptDeclaration{}, "alice")
+			if assert.Nil(t, limited, "other prompt %d", i) {
+				release()
+			}
+		}
+		_, limited = l.admit(ctx, "other", &PromptDeclaration{}, "alice")
+		assert.NotNil(t, limited)
+	})
+}
+
+func TestRunFuncRateLimited(t *testing.T) {
+	useTestLimiter(t, nil)
+	ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+	p := &PromptDeclaration{
+		Service:   Anthropic,
+		Cost:      fcs.ChargeData{Path: "test/path"},
+		RateLimit: &RateLimits{RequestsPerMinute: 2, Burst: 1},
+	}
+	calls := 0
+	executor := func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		calls++
+		return map[string]string{}, "done", nil, nil
+	}
+
+	w := httptest.NewRecorder()
+	runFunc(ctx, nil, "chat", p, PromptVariables{}, executor, nil, w)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	runFunc(ctx, nil, "chat", p, PromptVariables{}, executor, nil, w)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), string(ErrRateLimited))
+	assert.Equal(t, 1, calls)
+}
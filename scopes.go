@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const maxScopeExprDepth = 8
+
+// ScopeExpr is a boolean scope requirement. In JSON it is either a bare
+// scope name or an object with an any_of or all_of list of further
+// expressions, e.g. {"any_of": ["premium", "staff"]}.
+type ScopeExpr struct {
+	Scope string      `json:"-"`
+	AnyOf []ScopeExpr `json:"any_of,omitempty"`
+	AllOf []ScopeExpr `json:"all_of,omitempty"`
+}
+
+func (e *ScopeExpr) UnmarshalJSON(data []byte) error {
+	var scope string
+	if err := json.Unmarshal(data, &scope); err == nil {
+		*e = ScopeExpr{Scope: scope}
+		return nil
+	}
+	type plain ScopeExpr
+	var p plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return fmt.Errorf("scope expression: %w", err)
+	}
+	*e = ScopeExpr(p)
+	return nil
+}
+
+func (e ScopeExpr) MarshalJSON() ([]byte, error) {
+	if e.Scope != "" {
+		return json.Marshal(e.Scope)
+	}
+	type plain ScopeExpr
+	return json.Marshal(plain(e))
+}
+
+// Validate checks that every node is exactly one of a scope, a non-empty
+// any_of or a non-empty all_of.
+func (e ScopeExpr) Validate() error {
+	return e.validate(0)
+}
+
+func (e ScopeExpr) validate(depth int) error {
+	if depth > maxScopeExprDepth {
+		return fmt.Errorf("scope expression nested deeper than %d", maxScopeExprDepth)
+	}
+	set := 0
+	if e.Scope != "" {
+		set++
+		if strings.ContainsAny(e.Scope, " \t\n") {
+			return fmt.Errorf("scope %q contains whitespace", e.Scope)
+		}
+	}
+	if e.AnyOf != nil {
+		set++
+	}
+	if e.AllOf != nil {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("scope expression needs exactly one of a scope, any_of or all_of")
+	}
+	for _, list := range [][]ScopeExpr{e.AnyOf, e.AllOf} {
+		if list != nil && len(list) == 0 {
+			return fmt.Errorf("scope expression list is empty")
+		}
+		for _, sub := range list {
+			if err := sub.validate(depth + 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isZero reports an empty expression, which only middleware for routes open
+// to any authenticated caller uses.
+func (e ScopeExpr) isZero() bool {
+	return e.Scope == "" && len(e.AnyOf) == 0 && len(e.AllOf) == 0
+}
+
+// Satisfied reports whether the granted scopes meet the expression.
+func (e ScopeExpr) Satisfied(granted map[string]bool) bool {
+	switch {
+	case e.Scope != "":
+		return granted[e.Scope]
+	case len(e.AnyOf) > 0:
+		for _, sub := range e.AnyOf {
+			if sub.Satisfied(granted) {
+				return true
+			}
+		}
+		return false
+	case len(e.AllOf) > 0:
+		for _, sub := range e.AllOf {
+			if !sub.Satisfied(granted) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// claimScopes gathers the granted scopes from the scopes, scope and scp
+// claims. Each may be a space separated string or an array of strings, as
+// different identity providers issue them.
+func claimScopes(c map[string]interface{}) map[string]bool {
+	granted := make(map[string]bool)
+	for _, name := range []string{"scopes", "scope", "scp"} {
+		switch v := c[name].(type) {
+		case string:
+			for _, s := range strings.Fields(v) {
+				granted[s] = true
+			}
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok && s != "" {
+					granted[s] = true
+				}
+			}
+		case []string:
+			for _, s := range v {
+				granted[s] = true
+			}
+		}
+	}
+	return granted
+}
+
+// scopeRequirement returns the prompt's required_scopes expression, or its
+// single required_scope.
+func (pd *PromptDeclaration) scopeRequirement() ScopeExpr {
+	if pd.RequiredScopes != nil {
+		return *pd.RequiredScopes
+	}
+	return ScopeExpr{Scope: pd.RequiredScope}
+}
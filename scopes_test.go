@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeExprUnmarshalValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		wantErr   bool
+		wantValid bool
+	}{
+		{name: "bare scope", json: `"premium"`, wantValid: true},
+		{name: "any_of", json: `{"any_of": ["premium", "staff"]}`, wantValid: true},
+		{name: "nested", json: `{"all_of": ["read", {"any_of": ["premium", "staff"]}]}`, wantValid: true},
+		{name: "unknown key", json: `{"anyof": ["premium"]}`, wantErr: true},
+		{name: "both lists", json: `{"any_of": ["a"], "all_of": ["b"]}`},
+		{name: "empty list", json: `{"any_of": []}`},
+		{name: "empty object", json: `{}`},
+		{name: "empty scope", json: `{"any_of": [""]}`},
+		{name: "space in scope", json: `"premium staff"`},
+		{name: "too deep", json: `{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":[{"any_of":["x"]}]}]}]}]}]}]}]}]}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e ScopeExpr
+			err := json.Unmarshal([]byte(tt.json), &e)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.wantValid {
+				assert.NoError(t, e.Validate())
+			} else {
+				assert.Error(t, e.Validate())
+			}
+		})
+	}
+}
+
+func TestScopeExprSatisfied(t *testing.T) {
+	premiumOrStaff := ScopeExpr{AnyOf: []ScopeExpr{{Scope: "premium"}, {Scope: "staff"}}}
+	readAndPremiumOrStaff := ScopeExpr{AllOf: []ScopeExpr{{Scope: "read"}, premiumOrStaff}}
+
+	tests := []struct {
+		name   string
+		expr   ScopeExpr
+		claims map[string]interface{}
+		want   bool
+	}{
+		{name: "any_of first", expr: premiumOrStaff, claims: map[string]interface{}{"scopes": "premium"}, want: true},
+		{name: "any_of second", expr: premiumOrStaff, claims: map[string]interface{}{"scopes": "read staff"}, want: true},
+		{name: "any_of none", expr: premiumOrStaff, claims: map[string]interface{}{"scopes": "read"}, want: false},
+		{name: "all_of met", expr: readAndPremiumOrStaff, claims: map[string]interface{}{"scopes": "read staff"}, want: true},
+		{name: "all_of partial", expr: readAndPremiumOrStaff, claims: map[string]interface{}{"scopes": "staff"}, want: false},
+		{name: "scp array", expr: premiumOrStaff, claims: map[string]interface{}{"scp": []interface{}{"staff"}}, want: true},
+		{name: "scope string", expr: premiumOrStaff, claims: map[string]interface{}{"scope": "openid premium"}, want: true},
+		{name: "claims combined", expr: readAndPremiumOrStaff, claims: map[string]interface{}{"scope": "read", "scp": []interface{}{"premium"}}, want: true},
+		{name: "no claims", expr: premiumOrStaff, claims: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.expr.Satisfied(claimScopes(tt.claims)))
+		})
+	}
+}
+
+func TestValidatePromptRequiredScopes(t *testing.T) {
+	system := "You are helpful"
+	base := PromptDeclaration{
+		Service:   Anthropic,
+		Model:     "claude",
+		MaxTokens: 100,
+		System:    &system,
+	}
+	base.Cost.Path = "test/path"
+
+	tests := []struct {
+		name   string
+		scope  string
+		scopes *ScopeExpr
+		want   bool
+	}{
+		{name: "single scope", scope: "hello", want: true},
+		{name: "expression", scopes: &ScopeExpr{AnyOf: []ScopeExpr{{Scope: "premium"}, {Scope: "staff"}}}, want: true},
+		{name: "neither", want: false},
+		{name: "both", scope: "hello", scopes: &ScopeExpr{Scope: "premium"}, want: false},
+		{name: "invalid expression", scopes: &ScopeExpr{AnyOf: []ScopeExpr{}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := base
+			p.RequiredScope = tt.scope
+			p.RequiredScopes = tt.scopes
+			assert.Equal(t, tt.want, ValidatePromptDeclartion("test", &p))
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conversation store backends selected with CONVERSATION_STORE.
+const (
+	MemoryStore = "memory"
+	BoltStore   = "bolt"
+)
+
+const defaultConversationTTL = 7 * 24 * time.Hour
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// ConversationStore keeps sealed contexts server side so clients only hold
+// a short conversation ID. The stored value is the same bound, encrypted
+// context a client would otherwise carry, so a store leak exposes nothing
+// the context key does not protect.
+type ConversationStore interface {
+	// Get returns the context saved under id, or errConversationNotFound
+	// if there is none or it has expired.
+	Get(ctx context.Context, id string) (string, error)
+	// Put saves a context under id until expires, replacing any earlier one.
+	Put(ctx context.Context, id string, sealed string, expires time.Time) error
+	Close() error
+}
+
+var (
+	conversationStore ConversationStore
+	conversationTTL   = defaultConversationTTL
+	// ConversationIDKey carries the ID a continuation was loaded from, so
+	// the next turn is saved back under it.
+	ConversationIDKey = contextKey("conversation_id")
+)
+
+func init() {
+	store, err := openConversationStore(os.Getenv("CONVERSATION_STORE"), os.Getenv("CONVERSATION_STORE_PATH"))
+	if err != nil {
+		panic(fmt.Sprintf("conversation store setup failed: %v", err))
+	}
+	conversationStore = store
+	ttl, err := durationEnv("CONVERSATION_TTL", defaultConversationTTL)
+	if err != nil {
+		panic(err.Error())
+	}
+	conversationTTL = ttl
+}
+
+func openConversationStore(kind, path string) (ConversationStore, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case MemoryStore:
+		return newMemoryConversationStore(), nil
+	case BoltStore:
+		if path == "" {
+			return nil, fmt.Errorf("CONVERSATION_STORE_PATH must be set for the bolt store")
+		}
+		return openBoltConversationStore(path)
+	}
+	return nil, fmt.Errorf("unknown CONVERSATION_STORE %s", kind)
+}
+
+func newConversationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// conversationExpiry keeps a conversation as long as its context is valid,
+// or for CONVERSATION_TTL when the prompt sets no context_ttl.
+func conversationExpiry(pc *PromptContext) time.Time {
+	if pc.ExpiresAt != 0 {
+		return time.Unix(pc.ExpiresAt, 0)
+	}
+	return contextClock().Add(conversationTTL)
+}
+
+// storeConversation moves a result's context into the store, reusing the ID
+// the conversation was continued from.
+func storeConversation(ctx context.Context, store ConversationStore, pc *PromptContext, ret *Response) error {
+	id, _ := ctx.Value(ConversationIDKey).(string)
+	if id == "" {
+		var err error
+		if id, err = newConversationID(); err != nil {
+			return err
+		}
+	}
+	if err := store.Put(ctx, id, ret.Context, conversationExpiry(pc)); err != nil {
+		return err
+	}
+	ret.ConversationID = id
+	ret.Context = ""
+	return nil
+}
+
+type memoryConversation struct {
+	sealed  string
+	expires time.Time
+}
+
+type memoryConversationStore struct {
+	mu            sync.Mutex
+	conversations map[string]memoryConversation
+	puts          int
+}
+
+func newMemoryConversationStore() *memoryConversationStore {
+	return &memoryConversationStore{conversations: make(map[string]memoryConversation)}
+}
+
+func (s *memoryConversationStore) Get(ctx context.Context, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.conversations[id]
+	if !ok {
+		return "", errConversationNotFound
+	}
+	if !contextClock().Before(c.expires) {
+		delete(s.conversations, id)
+		return "", errConversationNotFound
+	}
+	return c.sealed, nil
+}
+
+func (s *memoryConversationStore) Put(ctx context.Context, id string, sealed string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[id] = memoryConversation{sealed: sealed, expires: expires}
+	// sweep now and then so abandoned conversations do not pile up
+	s.puts++
+	if s.puts%1000 == 0 {
+		now := contextClock()
+		for k, c := range s.conversations {
+			if !now.Before(c.expires) {
+				delete(s.conversations, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryConversationStore) Close() error {
+	return nil
+}
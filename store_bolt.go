@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var conversationBucket = []byte("conversations")
+
+// boltConversationStore keeps conversations in a BoltDB file. Each value is
+// the expiry in unix seconds, big endian, followed by the sealed context.
+type boltConversationStore struct {
+	db *bolt.DB
+}
+
+func openBoltConversationStore(path string) (*boltConversationStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	s := &boltConversationStore{db: db}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(conversationBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.sweep(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sweep drops expired conversations. It runs when the store is opened, and
+// Get drops expired entries it comes across.
+func (s *boltConversationStore) sweep() error {
+	now := contextClock().Unix()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conversationBucket)
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) <= now {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltConversationStore) Get(ctx context.Context, id string) (string, error) {
+	var sealed string
+	expired := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(conversationBucket).Get([]byte(id))
+		if len(v) < 8 {
+			return errConversationNotFound
+		}
+		if int64(binary.BigEndian.Uint64(v)) <= contextClock().Unix() {
+			expired = true
+			return errConversationNotFound
+		}
+		sealed = string(v[8:])
+		return nil
+	})
+	if expired {
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(conversationBucket).Delete([]byte(id))
+		}); err != nil {
+			fmt.Printf("failed to delete expired conversation %v\n", err)
+		}
+	}
+	return sealed, err
+}
+
+func (s *boltConversationStore) Put(ctx context.Context, id string, sealed string, expires time.Time) error {
+	v := make([]byte, 8, 8+len(sealed))
+	binary.BigEndian.PutUint64(v, uint64(expires.Unix()))
+	v = append(v, sealed...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationBucket).Put([]byte(id), v)
+	})
+}
+
+func (s *boltConversationStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func TestConversationStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) ConversationStore{
+		"memory": func(t *testing.T) ConversationStore {
+			return newMemoryConversationStore()
+		},
+		"bolt": func(t *testing.T) ConversationStore {
+			s, err := openBoltConversationStore(filepath.Join(t.TempDir(), "conversations.db"))
+			assert.NoError(t, err)
+			return s
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			contextClock = func() time.Time { return now }
+			defer func() { contextClock = time.Now }()
+
+			ctx := context.Background()
+			s := open(t)
+			defer s.Close()
+
+			_, err := s.Get(ctx, "missing")
+			assert.ErrorIs(t, err, errConversationNotFound)
+
+			assert.NoError(t, s.Put(ctx, "a", "first", now.Add(time.Hour)))
+			assert.NoError(t, s.Put(ctx, "a", "second", now.Add(time.Hour)))
+			got, err := s.Get(ctx, "a")
+			assert.NoError(t, err)
+			assert.Equal(t, "second", got)
+
+			now = now.Add(time.Hour)
+			_, err = s.Get(ctx, "a")
+			assert.ErrorIs(t, err, errConversationNotFound)
+		})
+	}
+}
+
+func TestBoltConversationStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.db")
+	ctx := context.Background()
+
+	s, err := openBoltConversationStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(ctx, "kept", "sealed", time.Now().Add(time.Hour)))
+	assert.NoError(t, s.Put(ctx, "stale", "sealed", time.Now().Add(-time.Hour)))
+	assert.NoError(t, s.Close())
+
+	s, err = openBoltConversationStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	got, err := s.Get(ctx, "kept")
+	assert.NoError(t, err)
+	assert.Equal(t, "sealed", got)
+	_, err = s.Get(ctx, "stale")
+	assert.ErrorIs(t, err, errConversationNotFound)
+}
+
+func TestConversationIDRoundTrip(t *testing.T) {
+	const fakeService = ServiceType("fake")
+	fake := &fakeProvider{}
+	RegisterProvider(fakeService, fake)
+	defer delete(providers, fakeService)
+
+	p := PromptDeclaration{
+		Service:       fakeService,
+		Cost:          fcs.ChargeData{Path: "test/path"},
+		RequiredScope: "hello",
+		Variables:     []VariableDeclaration{{Name: "NAME"}},
+	}
+	saved := prompts
+	prompts = PromptConfig{"fake": p}
+	defer func() { prompts = saved }()
+
+	conversationStore = newMemoryConversationStore()
+	defer func() { conversationStore = nil }()
+	apiKeys = map[string]APIKey{hashAPIKey("alice-key"): {ID: "alice", Scopes: []string{"hello"}}}
+	defer func() { apiKeys = nil }()
+
+	req := createTestRequest(map[string]string{"NAME": "bob"})
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, apiKeyPrincipalPrefix+"alice"))
+	w := httptest.NewRecorder()
+	constructPromptHandler("fake", &p).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var first Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.Empty(t, first.Context)
+	assert.Len(t, first.ConversationID, 32)
+
+	continueWith := func(form map[string]string) *httptest.ResponseRecorder {
+		req := createTestRequest(form)
+		req.Header.Set(apiKeyHeader, "alice-key")
+		w := httptest.NewRecorder()
+		continuance(w, req)
+		return w
+	}
+
+	w = continueWith(map[string]string{"CONVERSATION_ID": first.ConversationID, "USER_TEXT": "again"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var next Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &next))
+	assert.Equal(t, "continued again", next.Result)
+	assert.Equal(t, first.ConversationID, next.ConversationID)
+
+	w = continueWith(map[string]string{"CONVERSATION_ID": "0123456789abcdef0123456789abcdef"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// failingConversationStore refuses every write.
+type failingConversationStore struct {
+	ConversationStore
+}
+
+func (failingConversationStore) Put(ctx context.Context, id string, sealed string, expires time.Time) error {
+	return errors.New("disk full")
+}
+
+func TestRunFuncRefundsWhenStoreFails(t *testing.T) {
+	ledger := useTestLedger(t)
+	ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "alice")
+	ledger.AddCredits(ctx, "app/credits", "alice", 10)
+
+	conversationStore = failingConversationStore{newMemoryConversationStore()}
+	defer func() { conversationStore = nil }()
+
+	p := &PromptDeclaration{
+		Service:   Anthropic,
+		MaxTokens: 10,
+		Cost:      fcs.ChargeData{Path: "app/credits"},
+		Pricing:   &TokenPricing{OutputPer1K: 1000, Reserve: 10},
+	}
+	executor := func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		return map[string]string{}, "done", &TokenUsage{OutputTokens: 3}, nil
+	}
+	w := httptest.NewRecorder()
+	runFunc(ctx, &p.Cost, "chat", p, PromptVariables{}, executor, nil, w)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), string(ErrConversationStore))
+
+	balance, _ := ledger.Balance(ctx, "app/credits", "alice")
+	assert.Equal(t, 10, balance)
+	txs, _, err := ledger.History(ctx, "alice", "", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, txs, 2) {
+		assert.Equal(t, CreditRefund, txs[0].Kind)
+		assert.Equal(t, 10, txs[0].Amount)
+		assert.Equal(t, CreditCharge, txs[1].Kind)
+	}
+}
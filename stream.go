@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errClientGone marks a stream the client stopped reading. It is not an
+// upstream failure: the model ran, so the call is not refunded.
+var errClientGone = errors.New("client went away")
+
+// StreamExecutor runs a prompt and calls onDelta with each text fragment in
+// order as the model generates it. Returning an error from onDelta aborts the
+// upstream request, and the executor returns that error wrapped.
+type StreamExecutor func(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error)
+
+// StreamingProvider is implemented by providers that can forward text while
+// the model is still generating.
+type StreamingProvider interface {
+	ProcessPromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error)
+	ContinuePromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error)
+}
+
+// wantsStream reports whether the caller opted into Server-Sent Events with
+// either an Accept header or the stream query parameter.
+func wantsStream(r *http.Request) bool {
+	if strings.Contains(r.Header.Get("accept"), "text/event-stream") {
+		return true
+	}
+	stream, err := strconv.ParseBool(r.URL.Query().Get("stream"))
+	return err == nil && stream
+}
+
+// eventStream writes Server-Sent Events. Headers are sent with the first
+// event so failures before any output can still use a plain status code.
+type eventStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	return &eventStream{w: w}
+}
+
+func (s *eventStream) Send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshaling %s event: %w", event, err)
+	}
+	if !s.started {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.Header().Set("Connection", "keep-alive")
+		s.w.Header().Set("X-Accel-Buffering", "no")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (s *eventStream) Delta(text string) error {
+	if err := s.Send("delta", map[string]string{"text": text}); err != nil {
+		return fmt.Errorf("%w: %v", errClientGone, err)
+	}
+	return nil
+}
+
+// Fail reports a failure to the client. Once the stream has started the
+// status line is gone, so the error travels in an error event instead.
+func (s *eventStream) Fail(ctx context.Context, status int, apiErr APIError) {
+	if !s.started {
+		writeError(ctx, s.w, status, apiErr)
+		return
+	}
+	if err := s.Send("error", errorResponse(ctx, s.w, apiErr)); err != nil {
+		fmt.Printf("failed to send error event: %v\n", err)
+	}
+}
+
+// streamProcessExecutor adapts a provider's new conversation call to the
+// streaming protocol.
+func streamProcessExecutor(provider Provider, stream *eventStream) ModelExecutor {
+	if sp, ok := provider.(StreamingProvider); ok {
+		return streamingExecutor(sp.ProcessPromptStream, stream)
+	}
+	return bufferedStreamExecutor(provider.ProcessPrompt, stream)
+}
+
+// streamContinueExecutor adapts a provider's continue call to the streaming
+// protocol.
+func streamContinueExecutor(provider Provider, stream *eventStream) ModelExecutor {
+	if sp, ok := provider.(StreamingProvider); ok {
+		return streamingExecutor(sp.ContinuePromptStream, stream)
+	}
+	return bufferedStreamExecutor(provider.ContinuePrompt, stream)
+}
+
+func streamingExecutor(executor StreamExecutor, stream *eventStream) ModelExecutor {
+	return func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		return executor(p, vars, stream.Delta)
+	}
+}
+
+// bufferedStreamExecutor serves providers without native streaming by
+// delivering the whole result as a single delta once it is complete.
+func bufferedStreamExecutor(executor ModelExecutor, stream *eventStream) ModelExecutor {
+	return func(p *PromptDeclaration, vars PromptVariables) (interface{}, string, *TokenUsage, error) {
+		modelContext, result, usage, err := executor(p, vars)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if err := stream.Delta(result); err != nil {
+			// the tokens are spent, so report them for the charge
+			return nil, "", usage, fmt.Errorf("error sending delta: %w", err)
+		}
+		return modelContext, result, usage, nil
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+type fakeStreamingProvider struct {
+	fakeProvider
+	deltas []string
+	err    error
+}
+
+func (f *fakeStreamingProvider) ProcessPromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	for _, d := range f.deltas {
+		if err := onDelta(d); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if f.err != nil {
+		return nil, "", nil, f.err
+	}
+	return map[string]string{"history": "streamed"}, strings.Join(f.deltas, ""), nil, nil
+}
+
+func (f *fakeStreamingProvider) ContinuePromptStream(p *PromptDeclaration, vars PromptVariables, onDelta func(string) error) (interface{}, string, *TokenUsage, error) {
+	return f.ProcessPromptStream(p, vars, onDelta)
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+func readEvents(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		}
+	}
+	assert.NoError(t, scanner.Err())
+	return events
+}
+
+func TestWantsStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		accept string
+		want   bool
+	}{
+		{name: "plain request", url: "/v1/prompt/test", want: false},
+		{name: "accept header", url: "/v1/prompt/test", accept: "text/event-stream", want: true},
+		{name: "query parameter", url: "/v1/prompt/test?stream=true", want: true},
+		{name: "query parameter false", url: "/v1/prompt/test?stream=false", want: false},
+		{name: "json accept", url: "/v1/prompt/test", accept: "application/json", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.url, nil)
+			if tt.accept != "" {
+				r.Header.Set("accept", tt.accept)
+			}
+			assert.Equal(t, tt.want, wantsStream(r))
+		})
+	}
+}
+
+func TestStreamingPromptHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		provider   Provider
+		wantDeltas []string
+		wantResult string
+		wantError  bool
+	}{
+		{
+			name:       "native streaming",
+			provider:   &fakeStreamingProvider{deltas: []string{"Hel", "lo"}},
+			wantDeltas: []string{"Hel", "lo"},
+			wantResult: "Hello",
+		},
+		{
+			name:       "fallback for non streaming provider",
+			provider:   &fakeProvider{},
+			wantDeltas: []string{"processed bob"},
+			wantResult: "processed bob",
+		},
+		{
+			name:       "failure mid stream",
+			provider:   &fakeStreamingProvider{deltas: []string{"Hel"}, err: fmt.Errorf("connection reset")},
+			wantDeltas: []string{"Hel"},
+			wantError:  true,
+		},
+	}
+
+	const streamService = ServiceType("stream")
+	defer delete(providers, streamService)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RegisterProvider(streamService, tt.provider)
+			p := PromptDeclaration{
+				Service:   streamService,
+				Cost:      fcs.ChargeData{Path: "test/path"},
+				Variables: []VariableDeclaration{{Name: "NAME"}},
+			}
+
+			req := createTestRequest(map[string]string{"NAME": "bob"})
+			req.Header.Set("accept", "text/event-stream")
+			req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+			w := httptest.NewRecorder()
+			constructPromptHandler("stream", &p).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+			events := readEvents(t, w.Body.String())
+			var deltas []string
+			for _, e := range events {
+				if e.name == "delta" {
+					var d map[string]string
+					assert.NoError(t, json.Unmarshal([]byte(e.data), &d))
+					deltas = append(deltas, d["text"])
+				}
+			}
+			assert.Equal(t, tt.wantDeltas, deltas)
+
+			last := events[len(events)-1]
+			if tt.wantError {
+				assert.Equal(t, "error", last.name)
+				var body errorEnvelope
+				assert.NoError(t, json.Unmarshal([]byte(last.data), &body))
+				assert.Equal(t, ErrUpstream, body.Error.Code)
+				assert.NotEmpty(t, body.Error.RequestID)
+				return
+			}
+			assert.Equal(t, "done", last.name)
+			var resp Response
+			assert.NoError(t, json.Unmarshal([]byte(last.data), &resp))
+			assert.Equal(t, tt.wantResult, resp.Result)
+
+			pc, err := UnpackContext(resp.Context, "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, "stream", pc.Prompt)
+		})
+	}
+}
+
+func TestStreamingContinuanceHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    Provider
+		wantDeltas  []string
+		wantResult  string
+		wantError   bool
+		wantBalance int
+	}{
+		{
+			name:        "native streaming",
+			provider:    &fakeStreamingProvider{deltas: []string{"Go", "od"}},
+			wantDeltas:  []string{"Go", "od"},
+			wantResult:  "Good",
+			wantBalance: 7,
+		},
+		{
+			name:        "fallback for non streaming provider",
+			provider:    &fakeProvider{},
+			wantDeltas:  []string{"continued again"},
+			wantResult:  "continued again",
+			wantBalance: 7,
+		},
+		{
+			name:        "failure mid stream",
+			provider:    &fakeStreamingProvider{deltas: []string{"Go"}, err: fmt.Errorf("connection reset")},
+			wantDeltas:  []string{"Go"},
+			wantError:   true,
+			wantBalance: 10,
+		},
+	}
+
+	const streamService = ServiceType("stream")
+	defer delete(providers, streamService)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := useTestLedger(t)
+			ledger.AddCredits(context.Background(), "chat/path", "user1", 10)
+			RegisterProvider(streamService, tt.provider)
+			p := PromptDeclaration{Service: streamService, ContinueCost: &fcs.ChargeData{Path: "chat/path", Cost: 3}}
+
+			req := createTestRequest(map[string]string{"USER_TEXT": "again"})
+			req.URL.RawQuery = "stream=true"
+			req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+			w := httptest.NewRecorder()
+			continuanceConstructor("stream", &p, `{"history":"start"}`).ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			events := readEvents(t, w.Body.String())
+			var deltas []string
+			for _, e := range events {
+				if e.name == "delta" {
+					var d map[string]string
+					assert.NoError(t, json.Unmarshal([]byte(e.data), &d))
+					deltas = append(deltas, d["text"])
+				}
+			}
+			assert.Equal(t, tt.wantDeltas, deltas)
+
+			// a stream that fails after it has started still gives the charge back
+			balance, err := ledger.Balance(context.Background(), "chat/path", "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantBalance, balance)
+
+			last := events[len(events)-1]
+			if tt.wantError {
+				assert.Equal(t, "error", last.name)
+				return
+			}
+			assert.Equal(t, "done", last.name)
+			var resp Response
+			assert.NoError(t, json.Unmarshal([]byte(last.data), &resp))
+			assert.Equal(t, tt.wantResult, resp.Result)
+			assert.NotEmpty(t, resp.Context)
+		})
+	}
+}
+
+// goneWriter is a client that stopped reading before the first event.
+type goneWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (goneWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestStreamClientGoneKeepsCharge(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		pricing  *TokenPricing
+		want     int
+	}{
+		{name: "native streaming", provider: &fakeStreamingProvider{deltas: []string{"Hel", "lo"}}, want: 7},
+		{name: "fallback for non streaming provider", provider: &fakeProvider{}, want: 7},
+		{name: "metered without usage keeps the hold", provider: &fakeProvider{}, pricing: &TokenPricing{OutputPer1K: 1000, Reserve: 5}, want: 5},
+	}
+
+	const streamService = ServiceType("stream")
+	defer delete(providers, streamService)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := useTestLedger(t)
+			ctx := context.WithValue(context.Background(), AuthenticatedUserKey, "user1")
+			ledger.AddCredits(ctx, "chat/path", "user1", 10)
+			RegisterProvider(streamService, tt.provider)
+			p := &PromptDeclaration{Service: streamService, MaxTokens: 5, Cost: fcs.ChargeData{Path: "chat/path", Cost: 3}, Pricing: tt.pricing}
+
+			w := goneWriter{httptest.NewRecorder()}
+			stream := newEventStream(w)
+			runFunc(ctx, &p.Cost, "stream", p, PromptVariables{}, streamProcessExecutor(tt.provider, stream), stream, w)
+
+			balance, err := ledger.Balance(ctx, "chat/path", "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, balance)
+			txs, _, err := ledger.History(ctx, "user1", "", 10)
+			assert.NoError(t, err)
+			for _, tx := range txs {
+				assert.NotEqual(t, CreditRefund, tx.Kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// maxRenderedTemplateSize caps template output so a loop in a prompt cannot
+// grow a request without bound.
+const maxRenderedTemplateSize = 1 << 20
+
+var (
+	// legacyPlaceholder matches the original {{KEY}} placeholder syntax,
+	// which text/template would read as a function call.
+	legacyPlaceholder = regexp.MustCompile(`\{\{(-\s+|\s*)([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)(\s+-|\s*)\}\}`)
+
+	templateKeywords = map[string]bool{
+		"break": true, "continue": true, "else": true, "end": true,
+		"false": true, "nil": true, "true": true,
+		"and": true, "call": true, "html": true, "index": true, "js": true,
+		"len": true, "not": true, "or": true, "print": true, "printf": true,
+		"println": true, "slice": true, "urlquery": true,
+	}
+
+	templateFuncs = template.FuncMap{
+		"default": templateDefault,
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"trim":    strings.TrimSpace,
+		"split":   strings.Split,
+		"join":    func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	}
+
+	templateCache   = map[string]*template.Template{}
+	templateCacheMu sync.RWMutex
+)
+
+// templateDefault returns value unless it is empty, in which case def is
+// returned. It reads naturally at the end of a pipeline: {{.NAME | default "friend"}}
+func templateDefault(def interface{}, value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return def
+	case string:
+		if v == "" {
+			return def
+		}
+	case bool:
+		if !v {
+			return def
+		}
+	case int:
+		if v == 0 {
+			return def
+		}
+	}
+	return value
+}
+
+// rewriteLegacyPlaceholders turns {{KEY}} into {{.KEY}} so prompts written
+// for plain substitution keep working under text/template.
+func rewriteLegacyPlaceholders(text string) string {
+	return legacyPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		parts := legacyPlaceholder.FindStringSubmatch(m)
+		root := strings.SplitN(parts[2], ".", 2)[0]
+		if templateKeywords[root] || templateFuncs[root] != nil {
+			return m
+		}
+		return "{{" + parts[1] + "." + parts[2] + parts[3] + "}}"
+	})
+}
+
+// parsePromptTemplate parses a prompt template once and caches the result
+// by its source text.
+func parsePromptTemplate(text string) (*template.Template, error) {
+	templateCacheMu.RLock()
+	tmpl, ok := templateCache[text]
+	templateCacheMu.RUnlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New("prompt").
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(rewriteLegacyPlaceholders(text))
+	if err != nil {
+		return nil, err
+	}
+
+	templateCacheMu.Lock()
+	templateCache[text] = tmpl
+	templateCacheMu.Unlock()
+	return tmpl, nil
+}
+
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxRenderedTemplateSize {
+		return 0, fmt.Errorf("rendered template exceeds %d bytes", maxRenderedTemplateSize)
+	}
+	return b.Buffer.Write(p)
+}
+
+// renderPromptTemplate executes a prompt template against the request
+// variables. Values are never parsed as templates themselves.
+func renderPromptTemplate(text string, data map[string]interface{}) (string, error) {
+	tmpl, err := parsePromptTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+
+	var out limitedBuffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	return out.String(), nil
+}
+
+// renderedPrompt holds a declaration's templates rendered for one request.
+type renderedPrompt struct {
+	System       *string
+	InitialUser  *string
+	InitialAgent *string
+}
+
+func renderOptionalTemplate(text *string, data map[string]interface{}) (*string, error) {
+	if text == nil {
+		return nil, nil
+	}
+	rendered, err := renderPromptTemplate(*text, data)
+	if err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+func renderPrompt(p *PromptDeclaration, vars PromptVariables) (*renderedPrompt, error) {
+	var rp renderedPrompt
+	var err error
+	data := promptTemplateData(p, vars)
+	if rp.System, err = renderOptionalTemplate(p.System, data); err != nil {
+		return nil, fmt.Errorf("system: %w", err)
+	}
+	if rp.InitialUser, err = renderOptionalTemplate(p.InitialUser, data); err != nil {
+		return nil, fmt.Errorf("initial_user: %w", err)
+	}
+	if rp.InitialAgent, err = renderOptionalTemplate(p.InitialAgent, data); err != nil {
+		return nil, fmt.Errorf("initial_agent: %w", err)
+	}
+	return &rp, nil
+}
+
+// validatePromptTemplate parses text and checks that every top level field
+// it references is one of the allowed names.
+func validatePromptTemplate(text string, allowed map[string]bool) error {
+	tmpl, err := parsePromptTemplate(text)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	collectTemplateFields(tmpl.Tree.Root, true, names)
+	for name := range names {
+		if !allowed[name] {
+			return fmt.Errorf("template references undeclared variable %s", name)
+		}
+	}
+	return nil
+}
+
+// templateFieldName names a reference for validation. Claims are checked
+// one by one, so claims.locale keeps its second identifier.
+func templateFieldName(ident []string) string {
+	if ident[0] == claimsVariable && len(ident) > 1 {
+		return claimsVariable + "." + ident[1]
+	}
+	return ident[0]
+}
+
+// collectTemplateFields records the first identifier of each field reference
+// evaluated against the template's root data. Inside range and with the dot
+// moves, so only $-rooted references are collected there.
+func collectTemplateFields(node parse.Node, dotIsRoot bool, names map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectTemplateFields(child, dotIsRoot, names)
+		}
+	case *parse.ActionNode:
+		collectTemplateFields(n.Pipe, dotIsRoot, names)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectTemplateFields(cmd, dotIsRoot, names)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectTemplateFields(arg, dotIsRoot, names)
+		}
+	case *parse.ChainNode:
+		collectTemplateFields(n.Node, dotIsRoot, names)
+	case *parse.FieldNode:
+		if dotIsRoot {
+			names[templateFieldName(n.Ident)] = true
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			names[templateFieldName(n.Ident[1:])] = true
+		}
+	case *parse.IfNode:
+		collectTemplateFields(n.Pipe, dotIsRoot, names)
+		collectTemplateFields(n.List, dotIsRoot, names)
+		collectTemplateFields(n.ElseList, dotIsRoot, names)
+	case *parse.RangeNode:
+		collectTemplateFields(n.Pipe, dotIsRoot, names)
+		collectTemplateFields(n.List, false, names)
+		collectTemplateFields(n.ElseList, dotIsRoot, names)
+	case *parse.WithNode:
+		collectTemplateFields(n.Pipe, dotIsRoot, names)
+		collectTemplateFields(n.List, false, names)
+		collectTemplateFields(n.ElseList, dotIsRoot, names)
+	case *parse.TemplateNode:
+		collectTemplateFields(n.Pipe, dotIsRoot, names)
+	}
+}
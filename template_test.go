@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteLegacyPlaceholders(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "bare key", text: "Hello {{NAME}}", want: "Hello {{.NAME}}"},
+		{name: "spaced key", text: "Hello {{ NAME }}", want: "Hello {{ .NAME }}"},
+		{name: "trim markers", text: "Hello {{- NAME -}}!", want: "Hello {{- .NAME -}}!"},
+		{name: "dotted key", text: "{{claims.locale}}", want: "{{.claims.locale}}"},
+		{name: "already a field", text: "{{.NAME}}", want: "{{.NAME}}"},
+		{name: "keywords untouched", text: "{{if .A}}x{{else}}y{{end}}", want: "{{if .A}}x{{else}}y{{end}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rewriteLegacyPlaceholders(tt.text))
+		})
+	}
+}
+
+func TestRenderPromptTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		vars    PromptVariables
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "legacy placeholders",
+			text: "Dear {{NAME}}, about {{TOPIC}}",
+			vars: PromptVariables{"NAME": "Ann", "TOPIC": "tea"},
+			want: "Dear Ann, about tea",
+		},
+		{
+			name: "values are not expanded",
+			text: "{{A}} and {{B}}",
+			vars: PromptVariables{"A": "{{B}}", "B": "secret"},
+			want: "{{B}} and secret",
+		},
+		{
+			name: "conditional",
+			text: "{{if .FORMAL}}Dear{{else}}Hi{{end}} {{.NAME}}",
+			vars: PromptVariables{"FORMAL": "", "NAME": "Ann"},
+			want: "Hi Ann",
+		},
+		{
+			name: "range over split",
+			text: `{{range split .TAGS ","}}[{{trim .}}]{{end}}`,
+			vars: PromptVariables{"TAGS": "a, b,c"},
+			want: "[a][b][c]",
+		},
+		{
+			name: "default helper",
+			text: `Hello {{.NAME | default "friend"}}`,
+			vars: PromptVariables{"NAME": ""},
+			want: "Hello friend",
+		},
+		{
+			name:    "missing variable",
+			text:    "Hello {{.NAME}}",
+			vars:    PromptVariables{},
+			wantErr: true,
+		},
+		{
+			name:    "output too large",
+			text:    `{{range split .X ""}}{{printf "%1000000s" .}}{{end}}`,
+			vars:    PromptVariables{"X": "ab"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderPromptTemplate(tt.text, promptTemplateData(&PromptDeclaration{}, tt.vars))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidatePromptTemplate(t *testing.T) {
+	allowed := map[string]bool{"NAME": true, "ITEMS": true}
+	tests := []struct {
+		name    string
+		text    string
+		wantErr bool
+	}{
+		{name: "declared variable", text: "Hi {{NAME}}"},
+		{name: "range moves dot", text: `{{range split .ITEMS ","}}{{.Other}} {{$.NAME}}{{end}}`},
+		{name: "syntax error", text: "Hi {{if .NAME}}", wantErr: true},
+		{name: "undeclared variable", text: "Hi {{SURNAME}}", wantErr: true},
+		{name: "undeclared root reference in range", text: `{{range split .ITEMS ","}}{{$.SURNAME}}{{end}}`, wantErr: true},
+		{name: "unknown function", text: "{{shout .NAME}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePromptTemplate(tt.text, allowed)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRenderPrompt(t *testing.T) {
+	p := &PromptDeclaration{
+		System:      stringPtr("You help {{NAME}}"),
+		InitialUser: stringPtr("Hi"),
+	}
+	rendered, err := renderPrompt(p, PromptVariables{"NAME": "Ann"})
+	assert.NoError(t, err)
+	assert.Equal(t, "You help Ann", *rendered.System)
+	assert.Equal(t, "Hi", *rendered.InitialUser)
+	assert.Nil(t, rendered.InitialAgent)
+}
@@ -16,16 +16,44 @@ type contextKey string
 var (
 	AuthenticatedUserKey = contextKey("user_id")
 	tokenValidationURL   string
+	tokenValidationMode  = RemoteValidation
 )
 
 func init() {
-	tokenValidationURL = os.Getenv("TOKEN_VALIDATION_URL")
-	if tokenValidationURL == "" {
-		panic("TOKEN_VALIDATION_URL environment variable must be set")
+	if mode := os.Getenv("TOKEN_VALIDATION_MODE"); mode != "" {
+		tokenValidationMode = mode
+	}
+	switch tokenValidationMode {
+	case RemoteValidation:
+		tokenValidationURL = os.Getenv("TOKEN_VALIDATION_URL")
+		if tokenValidationURL == "" {
+			panic("TOKEN_VALIDATION_URL environment variable must be set")
+		}
+		if err := setupTokenCache(); err != nil {
+			panic(fmt.Sprintf("token cache setup failed: %v", err))
+		}
+	case JWKSValidation:
+		if err := setupJWKS(); err != nil {
+			panic(fmt.Sprintf("JWKS setup failed: %v", err))
+		}
+	default:
+		panic(fmt.Sprintf("unknown TOKEN_VALIDATION_MODE %s", tokenValidationMode))
 	}
 }
 
 func validateToken(tokenstring string) (map[string]interface{}, error) {
+	if tokenValidationMode == JWKSValidation {
+		return validateLocalToken(tokenstring)
+	}
+	if remoteTokenCache != nil {
+		return remoteTokenCache.validate(tokenstring, validateRemoteToken)
+	}
+	return validateRemoteToken(tokenstring)
+}
+
+// validateRemoteToken asks TOKEN_VALIDATION_URL whether the token is good and
+// then reads the claims from its payload.
+func validateRemoteToken(tokenstring string) (map[string]interface{}, error) {
 	req, err := http.NewRequest(http.MethodGet, tokenValidationURL, nil)
 	if err != nil {
 		return nil, err
@@ -35,15 +63,19 @@ func validateToken(tokenstring string) (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w %d", errTokenRejected, resp.StatusCode)
+	}
+	// anything else, a 5xx or 429 especially, says nothing about the token
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("token not valid %d", resp.StatusCode)
+		return nil, fmt.Errorf("token validation failed %d", resp.StatusCode)
 	}
 	sections := strings.Split(tokenstring, ".")
 	if len(sections) != 3 {
 		return nil, fmt.Errorf("bad token")
 	}
-	decoded := make([]byte, b64.RawStdEncoding.DecodedLen(len(sections[1])))
-	_, err = b64.RawStdEncoding.Decode(decoded, []byte(sections[1]))
+	decoded, err := b64.RawURLEncoding.DecodeString(strings.TrimRight(sections[1], "="))
 	if err != nil {
 		return nil, err
 	}
@@ -60,19 +92,19 @@ func validateAndGetClaims(w http.ResponseWriter, r *http.Request) map[string]int
 	auth := r.Header.Get("authorization")
 	if len(auth) < len("Bearer ") {
 		fmt.Printf("Bad Auth\n")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrMissingToken, Message: "a bearer token is required"})
 		return nil
 	}
 	auth = auth[7:]
 	validClaims, err := validateToken(auth)
 	if err != nil {
 		fmt.Printf("Error validating Token %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(r.Context(), w, http.StatusBadRequest, APIError{Code: ErrInvalidToken, Message: "token could not be validated"})
 		return nil
 	}
 	if validClaims == nil {
 		fmt.Printf("Token is not valid\n")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInvalidToken, Message: "token is not valid"})
 		return nil
 	}
 
@@ -80,58 +112,46 @@ func validateAndGetClaims(w http.ResponseWriter, r *http.Request) map[string]int
 }
 
 func checkScope(c map[string]interface{}, s string) bool {
-	scopesInterface := c["scopes"]
-	if scopesInterface == nil {
-		return false
-	}
-
-	scopes, ok := scopesInterface.(string)
-	if !ok {
-		return false
-	}
-
-	scopeSlice := strings.Split(scopes, " ")
-	for is := range scopeSlice {
-		if scopeSlice[is] == s {
-			return true
-		}
-	}
-
-	return false
+	return ScopeExpr{Scope: s}.Satisfied(claimScopes(c))
 }
 
 type TokenMiddleware struct {
-	handler        http.Handler
-	required_scope string
+	handler         http.Handler
+	required_scopes ScopeExpr
 }
 
 func (l *TokenMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	claims := validateAndGetClaims(w, r)
+	claims := authenticate(w, r)
 	if claims == nil {
 		return
 	}
-	if !checkScope(claims, l.required_scope) {
+	if !l.required_scopes.isZero() && !l.required_scopes.Satisfied(claimScopes(claims)) {
 		fmt.Printf("Token is not valid no scope.\n")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInsufficientScope, Message: "token lacks the required scope"})
 		return
 	}
 	uid_iface := claims["user_id"]
 	if uid_iface == nil {
 		fmt.Printf("Token is not valid no user_id\n")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInvalidToken, Message: "token has no user_id"})
 		return
 	}
 	uid, ok := uid_iface.(string)
 	if !ok || len(uid) <= 0 {
 		fmt.Printf("Token is not valid user_id bad\n")
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(r.Context(), w, http.StatusUnauthorized, APIError{Code: ErrInvalidToken, Message: "token has no user_id"})
 		return
 	}
 	ctxWithUser := context.WithValue(r.Context(), AuthenticatedUserKey, uid)
+	ctxWithUser = context.WithValue(ctxWithUser, AuthenticatedClaimsKey, claims)
 	rWithUser := r.WithContext(ctxWithUser)
 	l.handler.ServeHTTP(w, rWithUser)
 }
 
 func NewTokenMiddleware(handlerToWrap http.Handler, required_scope string) *TokenMiddleware {
-	return &TokenMiddleware{handlerToWrap, required_scope}
+	return NewScopedTokenMiddleware(handlerToWrap, ScopeExpr{Scope: required_scope})
+}
+
+func NewScopedTokenMiddleware(handlerToWrap http.Handler, required_scopes ScopeExpr) *TokenMiddleware {
+	return &TokenMiddleware{handlerToWrap, required_scopes}
 }
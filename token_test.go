@@ -6,6 +6,19 @@ import (
 	"testing"
 )
 
+// useTokenValidationURL points remote validation at a test server with the
+// token cache off, so results from another test's server are not reused.
+func useTokenValidationURL(t *testing.T, url string) {
+	t.Helper()
+	savedURL, savedCache := tokenValidationURL, remoteTokenCache
+	tokenValidationURL = url
+	remoteTokenCache = nil
+	t.Cleanup(func() {
+		tokenValidationURL = savedURL
+		remoteTokenCache = savedCache
+	})
+}
+
 func TestValidateToken(t *testing.T) {
 	// Setup mock token validation server
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -18,7 +31,7 @@ func TestValidateToken(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	tokenValidationURL = mockServer.URL
+	useTokenValidationURL(t, mockServer.URL)
 
 	tests := []struct {
 		name    string
@@ -68,7 +81,7 @@ func TestValidateAndGetClaims(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	tokenValidationURL = mockServer.URL
+	useTokenValidationURL(t, mockServer.URL)
 
 	tests := []struct {
 		name       string
@@ -166,7 +179,7 @@ func TestTokenMiddleware(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	tokenValidationURL = mockServer.URL
+	useTokenValidationURL(t, mockServer.URL)
 
 	// Create a test handler
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
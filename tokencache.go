@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenCacheTTL         = 5 * time.Minute
+	defaultTokenNegativeCacheTTL = 30 * time.Second
+	maxTokenCacheEntries         = 10000
+)
+
+// errTokenRejected marks a definite rejection by the validation endpoint,
+// as opposed to a failure to reach it, so only rejections are cached.
+var errTokenRejected = errors.New("token not valid")
+
+type tokenCacheEntry struct {
+	claims  map[string]interface{}
+	err     error
+	expires time.Time
+}
+
+// tokenCache remembers validation results keyed by a hash of the token so
+// raw bearer tokens are never held in memory longer than a request.
+type tokenCache struct {
+	mu          sync.Mutex
+	entries     map[[sha256.Size]byte]tokenCacheEntry
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+}
+
+var remoteTokenCache *tokenCache
+
+func newTokenCache(ttl, negativeTTL time.Duration) *tokenCache {
+	return &tokenCache{
+		entries:     make(map[[sha256.Size]byte]tokenCacheEntry),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+	}
+}
+
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// setupTokenCache reads TOKEN_CACHE_TTL and TOKEN_NEGATIVE_CACHE_TTL. A zero
+// TTL turns that half of the cache off.
+func setupTokenCache() error {
+	ttl, err := durationEnv("TOKEN_CACHE_TTL", defaultTokenCacheTTL)
+	if err != nil {
+		return err
+	}
+	negativeTTL, err := durationEnv("TOKEN_NEGATIVE_CACHE_TTL", defaultTokenNegativeCacheTTL)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 || negativeTTL > 0 {
+		remoteTokenCache = newTokenCache(ttl, negativeTTL)
+	}
+	return nil
+}
+
+func (c *tokenCache) get(tokenstring string) (tokenCacheEntry, bool) {
+	key := sha256.Sum256([]byte(tokenstring))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return tokenCacheEntry{}, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return tokenCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// put stores a result. Accepted tokens are kept for the TTL but never past
+// their own exp claim; rejections are kept for the negative TTL.
+func (c *tokenCache) put(tokenstring string, claims map[string]interface{}, err error) {
+	now := c.now()
+	var expires time.Time
+	switch {
+	case err == nil && c.ttl > 0:
+		expires = now.Add(c.ttl)
+		if exp, ok := claims["exp"].(float64); ok {
+			if tokenExp := time.Unix(int64(exp), 0); tokenExp.Before(expires) {
+				expires = tokenExp
+			}
+		}
+	case errors.Is(err, errTokenRejected) && c.negativeTTL > 0:
+		expires = now.Add(c.negativeTTL)
+	default:
+		return
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	key := sha256.Sum256([]byte(tokenstring))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxTokenCacheEntries {
+		c.evict(now)
+	}
+	c.entries[key] = tokenCacheEntry{claims: claims, err: err, expires: expires}
+}
+
+// evict drops expired entries, and if that frees nothing, an arbitrary one.
+func (c *tokenCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < maxTokenCacheEntries {
+			return
+		}
+		delete(c.entries, key)
+	}
+}
+
+// validate answers from the cache when it can and otherwise calls validator
+// and remembers the outcome.
+func (c *tokenCache) validate(tokenstring string, validator func(string) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	if entry, ok := c.get(tokenstring); ok {
+		return entry.claims, entry.err
+	}
+	claims, err := validator(tokenstring)
+	c.put(tokenstring, claims, err)
+	return claims, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCache(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	cache := newTokenCache(time.Minute, 10*time.Second)
+	cache.now = func() time.Time { return now }
+
+	calls := 0
+	results := map[string]error{
+		"good":     nil,
+		"rejected": fmt.Errorf("%w %d", errTokenRejected, 401),
+		"down":     errors.New("connection refused"),
+	}
+	validator := func(token string) (map[string]interface{}, error) {
+		calls++
+		if err := results[token]; err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"user_id": "qbert", "exp": float64(now.Unix() + 30)}, nil
+	}
+
+	claims, err := cache.validate("good", validator)
+	assert.NoError(t, err)
+	assert.Equal(t, "qbert", claims["user_id"])
+	_, _ = cache.validate("good", validator)
+	assert.Equal(t, 1, calls, "accepted token cached")
+
+	_, err = cache.validate("rejected", validator)
+	assert.ErrorIs(t, err, errTokenRejected)
+	_, err = cache.validate("rejected", validator)
+	assert.ErrorIs(t, err, errTokenRejected)
+	assert.Equal(t, 2, calls, "rejected token cached")
+
+	_, _ = cache.validate("down", validator)
+	_, _ = cache.validate("down", validator)
+	assert.Equal(t, 4, calls, "transport errors not cached")
+
+	now = now.Add(11 * time.Second)
+	_, _ = cache.validate("rejected", validator)
+	assert.Equal(t, 5, calls, "negative entry expired")
+	_, _ = cache.validate("good", validator)
+	assert.Equal(t, 5, calls, "positive entry still live")
+
+	now = now.Add(20 * time.Second)
+	_, _ = cache.validate("good", validator)
+	assert.Equal(t, 6, calls, "entry capped at token exp")
+}
+
+func TestTokenCacheDisabledHalves(t *testing.T) {
+	cache := newTokenCache(0, time.Minute)
+	cache.put("good", map[string]interface{}{"user_id": "qbert"}, nil)
+	_, ok := cache.get("good")
+	assert.False(t, ok)
+
+	cache = newTokenCache(time.Minute, 0)
+	cache.put("bad", nil, errTokenRejected)
+	_, ok = cache.get("bad")
+	assert.False(t, ok)
+}
+
+func TestValidateTokenCached(t *testing.T) {
+	calls := 0
+	status := http.StatusServiceUnavailable
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer mockServer.Close()
+	useTokenValidationURL(t, mockServer.URL)
+	remoteTokenCache = newTokenCache(time.Minute, time.Minute)
+
+	payload := fmt.Sprintf(`{"user_id":"qbert","exp":%d}`, time.Now().Add(time.Hour).Unix())
+	token := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+
+	// an unavailable validator is not a rejection and must not be cached
+	_, err := validateToken(token)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errTokenRejected)
+
+	status = http.StatusOK
+	for i := 0; i < 2; i++ {
+		claims, err := validateToken(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "qbert", claims["user_id"])
+	}
+	assert.Equal(t, 2, calls, "outage not cached, second success served from cache")
+}
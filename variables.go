@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+type VariableType string
+
+const (
+	StringVariable VariableType = "string"
+	IntVariable    VariableType = "int"
+	EnumVariable   VariableType = "enum"
+	BoolVariable   VariableType = "bool"
+)
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// VariableDeclaration describes one request variable. In the PROMPTS JSON a
+// variable is either a bare name, which declares an optional string, or an
+// object with constraints.
+type VariableDeclaration struct {
+	Name      string       `json:"name"`
+	Type      VariableType `json:"type,omitempty"` // 'string' (default), 'int', 'enum', or 'bool'
+	Required  bool         `json:"required,omitempty"`
+	Default   *string      `json:"default,omitempty"`
+	MaxLength int          `json:"max_length,omitempty"` // in characters, 0 for no limit
+	Pattern   string       `json:"pattern,omitempty"`    // regular expression the value must match
+	Values    []string     `json:"values,omitempty"`     // allowed values for enum
+	Min       *int         `json:"min,omitempty"`
+	Max       *int         `json:"max,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// VariableError names the request variable that failed validation.
+type VariableError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("variable %s: %s", e.Field, e.Message)
+}
+
+func (vd *VariableDeclaration) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*vd = VariableDeclaration{Name: name}
+		return nil
+	}
+
+	type plain VariableDeclaration
+	var decl plain
+	if err := json.Unmarshal(data, &decl); err != nil {
+		return err
+	}
+	*vd = VariableDeclaration(decl)
+	if vd.Pattern != "" {
+		// An invalid pattern is reported by Validate
+		vd.pattern, _ = regexp.Compile(vd.Pattern)
+	}
+	return nil
+}
+
+func (vd *VariableDeclaration) variableType() VariableType {
+	if vd.Type == "" {
+		return StringVariable
+	}
+	return vd.Type
+}
+
+// matcher returns the compiled pattern. Declarations loaded from JSON are
+// compiled once when unmarshaled; others compile on use.
+func (vd *VariableDeclaration) matcher() (*regexp.Regexp, error) {
+	if vd.pattern != nil || vd.Pattern == "" {
+		return vd.pattern, nil
+	}
+	return regexp.Compile(vd.Pattern)
+}
+
+// Validate checks the declaration itself, including that any default
+// satisfies its own constraints.
+func (vd *VariableDeclaration) Validate() error {
+	if !variableName.MatchString(vd.Name) {
+		return fmt.Errorf("invalid variable name %q", vd.Name)
+	}
+	// {{NAME}} is only rewritten to {{.NAME}} when NAME is not a template
+	// builtin or helper, so such a name could never be rendered
+	if templateKeywords[vd.Name] || templateFuncs[vd.Name] != nil {
+		return fmt.Errorf("variable name %q is reserved by templates", vd.Name)
+	}
+	// a request value would replace the claims map in the template data
+	if vd.Name == claimsVariable {
+		return fmt.Errorf("variable name %q is reserved for token claims", vd.Name)
+	}
+	switch vd.variableType() {
+	case StringVariable, IntVariable, BoolVariable:
+	case EnumVariable:
+		if len(vd.Values) == 0 {
+			return fmt.Errorf("enum variable %s requires values", vd.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type %s for variable %s", vd.Type, vd.Name)
+	}
+	if vd.MaxLength < 0 {
+		return fmt.Errorf("max_length for %s must not be negative", vd.Name)
+	}
+	if vd.Min != nil && vd.Max != nil && *vd.Min > *vd.Max {
+		return fmt.Errorf("min greater than max for %s", vd.Name)
+	}
+	if _, err := vd.matcher(); err != nil {
+		return fmt.Errorf("pattern for %s: %v", vd.Name, err)
+	}
+	if vd.Default != nil {
+		if _, err := vd.normalize(*vd.Default); err != nil {
+			return fmt.Errorf("default for %s: %v", vd.Name, err)
+		}
+	}
+	return nil
+}
+
+// normalize checks a supplied value against the declaration and returns its
+// canonical string form.
+func (vd *VariableDeclaration) normalize(value string) (string, error) {
+	if vd.MaxLength > 0 && utf8.RuneCountInString(value) > vd.MaxLength {
+		return "", fmt.Errorf("longer than %d characters", vd.MaxLength)
+	}
+
+	switch vd.variableType() {
+	case IntVariable:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("not an integer")
+		}
+		if vd.Min != nil && n < *vd.Min {
+			return "", fmt.Errorf("less than %d", *vd.Min)
+		}
+		if vd.Max != nil && n > *vd.Max {
+			return "", fmt.Errorf("greater than %d", *vd.Max)
+		}
+		value = strconv.Itoa(n)
+	case BoolVariable:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("not a boolean")
+		}
+		value = strconv.FormatBool(b)
+	case EnumVariable:
+		found := false
+		for _, allowed := range vd.Values {
+			if value == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("not one of the allowed values")
+		}
+	}
+
+	re, err := vd.matcher()
+	if err != nil {
+		return "", err
+	}
+	if re != nil && !re.MatchString(value) {
+		return "", fmt.Errorf("does not match pattern")
+	}
+	return value, nil
+}
+
+// Resolve applies defaults and constraints to a raw request value. An empty
+// value counts as missing.
+func (vd *VariableDeclaration) Resolve(value string) (string, error) {
+	if value == "" {
+		if vd.Default != nil {
+			return *vd.Default, nil
+		}
+		if vd.Required {
+			return "", &VariableError{Field: vd.Name, Message: "required"}
+		}
+		return "", nil
+	}
+	normalized, err := vd.normalize(value)
+	if err != nil {
+		return "", &VariableError{Field: vd.Name, Message: err.Error()}
+	}
+	return normalized, nil
+}
+
+// templateValue converts a resolved value to the type templates see, so a
+// false bool or a zero int test false in {{if}}.
+func (vd *VariableDeclaration) templateValue(value string) interface{} {
+	switch vd.variableType() {
+	case IntVariable:
+		n, _ := strconv.Atoi(value)
+		return n
+	case BoolVariable:
+		b, _ := strconv.ParseBool(value)
+		return b
+	}
+	return value
+}
+
+// promptTemplateData builds template data from request variables, typing
+// each declared variable and nesting exposed claims under claims.
+func promptTemplateData(p *PromptDeclaration, vars PromptVariables) map[string]interface{} {
+	data := make(map[string]interface{}, len(vars))
+	claims := make(map[string]interface{})
+	for k, v := range vars {
+		if name, ok := splitClaimVariable(k); ok {
+			claims[name] = v
+			continue
+		}
+		data[k] = v
+	}
+	if len(claims) > 0 {
+		data[claimsVariable] = claims
+	}
+	for i := range p.Variables {
+		vd := &p.Variables[i]
+		if value, ok := vars[vd.Name]; ok {
+			data[vd.Name] = vd.templateValue(value)
+		}
+	}
+	return data
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	fcs "github.com/tmiv/firebase-credit-service"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestVariableDeclarationUnmarshal(t *testing.T) {
+	var vars []VariableDeclaration
+	err := json.Unmarshal([]byte(`[
+		"NAME",
+		{"name": "AGE", "type": "int", "required": true, "min": 0, "max": 150},
+		{"name": "CODE", "pattern": "^[A-Z]{3}$"}
+	]`), &vars)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(vars))
+	assert.Equal(t, VariableDeclaration{Name: "NAME"}, vars[0])
+	assert.Equal(t, IntVariable, vars[1].Type)
+	assert.True(t, vars[1].Required)
+	assert.Equal(t, 150, *vars[1].Max)
+	assert.NotNil(t, vars[2].pattern)
+}
+
+func TestVariableDeclarationValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		decl    VariableDeclaration
+		wantErr bool
+	}{
+		{name: "plain string", decl: VariableDeclaration{Name: "NAME"}},
+		{name: "bad name", decl: VariableDeclaration{Name: "claims.locale"}, wantErr: true},
+		{name: "template builtin name", decl: VariableDeclaration{Name: "len"}, wantErr: true},
+		{name: "claims namespace name", decl: VariableDeclaration{Name: "claims"}, wantErr: true},
+		{name: "template helper name", decl: VariableDeclaration{Name: "upper"}, wantErr: true},
+		{name: "builtin name in other case", decl: VariableDeclaration{Name: "INDEX"}},
+		{name: "unknown type", decl: VariableDeclaration{Name: "X", Type: "float"}, wantErr: true},
+		{name: "enum without values", decl: VariableDeclaration{Name: "X", Type: EnumVariable}, wantErr: true},
+		{name: "bad pattern", decl: VariableDeclaration{Name: "X", Pattern: "("}, wantErr: true},
+		{name: "min above max", decl: VariableDeclaration{Name: "X", Type: IntVariable, Min: intPtr(5), Max: intPtr(1)}, wantErr: true},
+		{name: "default violates constraint", decl: VariableDeclaration{Name: "X", Type: IntVariable, Default: stringPtr("ten")}, wantErr: true},
+		{name: "valid default", decl: VariableDeclaration{Name: "X", Type: EnumVariable, Values: []string{"a", "b"}, Default: stringPtr("b")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.decl.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVariableDeclarationResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		decl    VariableDeclaration
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "optional missing", decl: VariableDeclaration{Name: "X"}, value: "", want: ""},
+		{name: "required missing", decl: VariableDeclaration{Name: "X", Required: true}, value: "", wantErr: true},
+		{name: "default applied", decl: VariableDeclaration{Name: "X", Required: true, Default: stringPtr("d")}, value: "", want: "d"},
+		{name: "max length", decl: VariableDeclaration{Name: "X", MaxLength: 3}, value: "abcd", wantErr: true},
+		{name: "max length counts characters", decl: VariableDeclaration{Name: "X", MaxLength: 3}, value: "äöü", want: "äöü"},
+		{name: "int normalized", decl: VariableDeclaration{Name: "X", Type: IntVariable}, value: "+042", want: "42"},
+		{name: "int invalid", decl: VariableDeclaration{Name: "X", Type: IntVariable}, value: "4.2", wantErr: true},
+		{name: "int above max", decl: VariableDeclaration{Name: "X", Type: IntVariable, Max: intPtr(10)}, value: "11", wantErr: true},
+		{name: "bool normalized", decl: VariableDeclaration{Name: "X", Type: BoolVariable}, value: "1", want: "true"},
+		{name: "bool invalid", decl: VariableDeclaration{Name: "X", Type: BoolVariable}, value: "maybe", wantErr: true},
+		{name: "enum allowed", decl: VariableDeclaration{Name: "X", Type: EnumVariable, Values: []string{"a", "b"}}, value: "b", want: "b"},
+		{name: "enum rejected", decl: VariableDeclaration{Name: "X", Type: EnumVariable, Values: []string{"a", "b"}}, value: "c", wantErr: true},
+		{name: "pattern match", decl: VariableDeclaration{Name: "X", Pattern: "^[A-Z]{3}$"}, value: "ABC", want: "ABC"},
+		{name: "pattern mismatch", decl: VariableDeclaration{Name: "X", Pattern: "^[A-Z]{3}$"}, value: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decl.Resolve(tt.value)
+			if tt.wantErr {
+				var verr *VariableError
+				assert.ErrorAs(t, err, &verr)
+				assert.Equal(t, "X", verr.Field)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPromptTemplateDataTypes(t *testing.T) {
+	p := &PromptDeclaration{
+		Variables: []VariableDeclaration{
+			{Name: "FORMAL", Type: BoolVariable},
+			{Name: "COUNT", Type: IntVariable},
+			{Name: "NAME"},
+		},
+	}
+	data := promptTemplateData(p, PromptVariables{"FORMAL": "false", "COUNT": "3", "NAME": "Ann"})
+	assert.Equal(t, false, data["FORMAL"])
+	assert.Equal(t, 3, data["COUNT"])
+	assert.Equal(t, "Ann", data["NAME"])
+
+	got, err := renderPromptTemplate("{{if .FORMAL}}Dear{{else}}Hi{{end}} {{.NAME}}", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi Ann", got)
+}
+
+func TestInvalidVariableRejectedBeforeExecution(t *testing.T) {
+	const fakeService = ServiceType("fake")
+	fake := &fakeProvider{}
+	RegisterProvider(fakeService, fake)
+	defer delete(providers, fakeService)
+
+	p := PromptDeclaration{
+		Service: fakeService,
+		Cost:    fcs.ChargeData{Path: "test/path", Cost: 1},
+		Variables: []VariableDeclaration{
+			{Name: "AGE", Type: IntVariable, Required: true},
+		},
+	}
+
+	req := createTestRequest(map[string]string{"AGE": "old"})
+	req = req.WithContext(context.WithValue(req.Context(), AuthenticatedUserKey, "user1"))
+	w := httptest.NewRecorder()
+	constructPromptHandler("fake", &p).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, fake.processed)
+	var body errorEnvelope
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, ErrInvalidVariable, body.Error.Code)
+	assert.Equal(t, "AGE", body.Error.Field)
+}